@@ -17,6 +17,11 @@ const (
 	BNODE_LEAF = 2
 )
 
+// values are below 4KB, the top bits of vlen are flags
+const BNODE_VAL_FLAGS = 0xf000
+const BNODE_VAL_COMPRESSED = 0x8000
+const BNODE_VAL_TTL = 0x4000
+
 // header
 func (node BNode) btype() uint16 {
 	return binary.LittleEndian.Uint16(node.data)
@@ -75,12 +80,19 @@ func (node BNode) getKey(index uint16) []byte {
 	return node.data[pos + 4:][:klen]
 }
 
-func (node BNode) getValue(index uint16) []byte {
+// the value as it is in the page, and the flags from the top of vlen
+func (node BNode) getStored(index uint16) ([]byte, uint16) {
 	assert(index <= node.nkeys())
 	pos := node.kvPos(index)
 	klen := binary.LittleEndian.Uint16(node.data[pos + 0:])
 	vlen := binary.LittleEndian.Uint16(node.data[pos + 2:])
-	return node.data[pos + 4 + klen:][:vlen]
+	vflags := vlen & BNODE_VAL_FLAGS
+	return node.data[pos + 4 + klen:][:vlen &^ BNODE_VAL_FLAGS], vflags
+}
+
+// the value without its expiry, decompressed if needed
+func (node BNode) getValue(index uint16) ([]byte, error) {
+	return valueLogical(node.getStored(index))
 }
 
 func (node BNode) nbytes() uint16 {
@@ -93,7 +105,7 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 	found := uint16(0)
 
 	for i := uint16(1); i < nk; i++ {
-		cmp := bytes.Compare(key, node.getKey(i))
+		cmp := bytes.Compare(node.getKey(i), key)
 		
 		if cmp <= 0 {
 			found = i
@@ -129,11 +141,16 @@ func nodeAppendRange(new BNode, old BNode, dst uint16, src uint16, n uint16) {
 }
 
 func nodeAppendKV(node BNode, index uint16, ptr uint64, key []byte, value []byte) {	
+	nodeAppendKVFlags(node, index, ptr, key, value, 0)
+}
+
+func nodeAppendKVFlags(node BNode, index uint16, ptr uint64, key []byte, value []byte, vflags uint16) {
+	assert(uint16(len(value)) & BNODE_VAL_FLAGS == 0)
 	node.setPtr(index, ptr)
 	
 	pos := node.kvPos(index)	
 	binary.LittleEndian.PutUint16(node.data[pos + 0:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(node.data[pos + 2:], uint16(len(value)))
+	binary.LittleEndian.PutUint16(node.data[pos + 2:], uint16(len(value)) | vflags)
 	copy(node.data[pos + 4:], key)
 	copy(node.data[pos + 4 + uint16(len(key)):], value)
 
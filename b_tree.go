@@ -2,6 +2,7 @@ package pandora_db
 
 import (
 	"bytes"
+	"time"
 )
 
 type BTree struct {
@@ -10,10 +11,20 @@ type BTree struct {
 	get func(uint64) BNode
 	new func(BNode) uint64
 	del func(uint64)
+	// like `get`, the page stays cached until `unpin`, nil for trees
+	// whose pages are not in a pager
+	pin func(uint64) BNode
+	unpin func(uint64)
+	// called with the error of a value that can't be decoded, which
+	// reads as missing
+	corrupt func(error)
 }
 
 func (tree *BTree) Get(key []byte) ([]byte, bool) {
 	assert(len(key) <= BTREE_MAX_KEY_SIZE)
+	if tree.root == 0 {
+		return nil, false
+	}
 
 	root := tree.get(tree.root)
 
@@ -22,6 +33,39 @@ func (tree *BTree) Get(key []byte) ([]byte, bool) {
 	return val, val != nil	
 }
 
+// the value as it is stored, expired or not
+func (tree *BTree) getStored(key []byte) ([]byte, uint16, bool) {
+	if tree.root == 0 {
+		return nil, 0, false
+	}
+	found := false
+	var stored []byte
+	var vflags uint16
+	treeScanPage(tree, tree.root, key, func(node BNode, index uint16) bool {
+		if bytes.Equal(key, node.getKey(index)) {
+			stored, vflags = node.getStored(index)
+			found = true
+		}
+		return false
+	})
+	return stored, vflags, found
+}
+
+// Scan calls `fn` with the keys from `start` on in order until it
+// returns false. Expired keys are skipped.
+func (tree *BTree) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	if tree.root == 0 {
+		return
+	}
+	treeScanPage(tree, tree.root, start, func(node BNode, index uint16) bool {
+		val := leafGet(tree, node, index)
+		if val == nil {
+			return true
+		}
+		return fn(node.getKey(index), val)
+	})
+}
+
 func (tree *BTree) Delete(key []byte) bool {
 	assert(len(key) != 0)
 	assert(len(key) <= BTREE_MAX_KEY_SIZE)
@@ -44,16 +88,21 @@ func (tree *BTree) Delete(key []byte) bool {
 }
 
 func (tree *BTree) Insert(key []byte, val []byte) {
+	tree.insert(key, val, 0)
+}
+
+// insert a value stored with `vflags`, see `valueEncode`
+func (tree *BTree) insert(key []byte, val []byte, vflags uint16) {
 	assert(len(key) != 0)
 	assert(len(key) <= BTREE_MAX_KEY_SIZE)
-	assert(len(val) <= BTREE_MAX_VAL_SIZE)
+	assert(len(val) <= BTREE_MAX_VAL_SIZE + VALUE_TTL_SIZE)
 	
 	if tree.root == 0 {
 		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 		root.setHeader(BNODE_LEAF, 2)
 		// dummy key
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		nodeAppendKVFlags(root, 1, 0, key, val, vflags)
 		tree.root = tree.new(root)
 		return
 	}
@@ -61,7 +110,7 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	node := tree.get(tree.root)
 	tree.del(tree.root)
 
-	node = treeInsert(tree, node, key, val)
+	node = treeInsert(tree, node, key, val, vflags)
 	nsplit, splited := nodeSplit3(node)
 	if nsplit > 1 {
 		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
@@ -85,7 +134,7 @@ func treeGet(tree *BTree, node BNode, key []byte) []byte {
 	switch node.btype() {
 	case BNODE_LEAF:
 		if bytes.Equal(key, node.getKey(index)) {
-			return leafGet(node, index)
+			return leafGet(tree, node, index)
 		}
 		return nil
 	case BNODE_NODE:
@@ -95,8 +144,49 @@ func treeGet(tree *BTree, node BNode, key []byte) []byte {
 	}		
 }
 
+// call `fn` with the leaf entries from `start` on until it returns false
+func treeScan(tree *BTree, node BNode, start []byte, fn func(BNode, uint16) bool) bool {
+	index := nodeLookupLE(node, start)
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		if bytes.Compare(node.getKey(index), start) < 0 {
+			index++
+		}
+		for ; index < node.nkeys(); index++ {
+			if len(node.getKey(index)) == 0 {
+				continue // dummy key
+			}
+			if !fn(node, index) {
+				return false
+			}
+		}
+		return true
+	case BNODE_NODE:
+		for ; index < node.nkeys(); index++ {
+			if !treeScanPage(tree, node.getPtr(index), start, fn) {
+				return false
+			}
+		}
+		return true
+	default:
+		panic("invalid node type")
+	}
+}
+
+// `treeScan` of the page `ptr`, which stays pinned in the pager until
+// the scan is done with it
+func treeScanPage(tree *BTree, ptr uint64, start []byte, fn func(BNode, uint16) bool) bool {
+	if tree.pin == nil {
+		return treeScan(tree, tree.get(ptr), start, fn)
+	}
+	node := tree.pin(ptr)
+	defer tree.unpin(ptr)
+	return treeScan(tree, node, start, fn)
+}
+
 // tree insert
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte, vflags uint16) BNode {
 	new := BNode{data: make([]byte, 2 * BTREE_PAGE_SIZE)}
 
 	index := nodeLookupLE(node, key)
@@ -104,12 +194,12 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	switch node.btype() {
 	case BNODE_LEAF:
 		if bytes.Equal(key, node.getKey(index)) {
-			leafUpdate(new, node, index, key, val)
+			leafUpdate(new, node, index, key, val, vflags)
 		} else {
-			leafInsert(new, node, index + 1, key, val)
+			leafInsert(new, node, index + 1, key, val, vflags)
 		}
 	case BNODE_NODE:
-		nodeInsert(tree, new, node, index, key, val)
+		nodeInsert(tree, new, node, index, key, val, vflags)
 	default:
 		panic("invalid node type")
 	}
@@ -136,24 +226,35 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	}	
 }
 
-// leaf get
-func leafGet(node BNode, index uint16) []byte {
-	return node.getValue(index)
+// leaf get, nil once the value expired
+func leafGet(tree *BTree, node BNode, index uint16) []byte {
+	stored, vflags := node.getStored(index)
+	if valueExpired(stored, vflags, time.Now().UnixNano()) {
+		return nil
+	}
+	val, err := node.getValue(index)
+	if err != nil {
+		if tree.corrupt != nil {
+			tree.corrupt(err)
+		}
+		return nil
+	}
+	return val
 }
 
 // leaf insert
-func leafInsert(new BNode, old BNode, index uint16, key []byte, value []byte) {
+func leafInsert(new BNode, old BNode, index uint16, key []byte, value []byte, vflags uint16) {
 	new.setHeader(BNODE_LEAF, old.nkeys() + 1)
 	nodeAppendRange(new, old, 0, 0, index)
-	nodeAppendKV(new, index, 0, key, value)
+	nodeAppendKVFlags(new, index, 0, key, value, vflags)
 	nodeAppendRange(new, old, index + 1, index, old.nkeys() - index)
 }
 
 // leaf update
-func leafUpdate(new BNode, old BNode, index uint16, key []byte, value []byte) {
+func leafUpdate(new BNode, old BNode, index uint16, key []byte, value []byte, vflags uint16) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
 	nodeAppendRange(new, old, 0, 0, index)
-	nodeAppendKV(new, index, 0, key, value)
+	nodeAppendKVFlags(new, index, 0, key, value, vflags)
 	nodeAppendRange(new, old, index + 1, index + 1, old.nkeys() - index - 1)
 }
 
@@ -173,13 +274,13 @@ func nodeGet(tree *BTree, node BNode, index uint16, key []byte) []byte {
 }
 
 // node insert
-func nodeInsert(tree *BTree, new BNode, node BNode, index uint16, key []byte, value []byte) {
+func nodeInsert(tree *BTree, new BNode, node BNode, index uint16, key []byte, value []byte, vflags uint16) {
 	kptr := node.getPtr(index)
 	knode := tree.get(kptr)
 	
 	tree.del(kptr)
 
-	knode = treeInsert(tree, knode, key, value)
+	knode = treeInsert(tree, knode, key, value, vflags)
 
 	nsplit, splited := nodeSplit3(knode)
 
@@ -209,7 +310,7 @@ func nodeDelete(tree *BTree, node BNode, index uint16, key []byte) BNode {
 		nodeReplace2Kid(new, node, index - 1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0:
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, sibling, updated)
+		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(index + 1))
 		nodeReplace2Kid(new, node, index, tree.new(merged), merged.getKey(0))
 	case mergeDir == 0:
@@ -228,7 +329,7 @@ func nodeReplace2Kid(new BNode, node BNode, index uint16, ptr uint64, key []byte
 	new.setHeader(node.btype(), node.nkeys() - 1)
 	nodeAppendRange(new, node, 0, 0, index)
 	nodeAppendKV(new, index, ptr, key, nil)
-	nodeAppendRange(new, node, index, index + 2, node.nkeys() - index - 2)
+	nodeAppendRange(new, node, index + 1, index + 2, node.nkeys() - index - 2)
 }
 
 func nodeMerge(new BNode, left BNode, right BNode) {
@@ -238,21 +339,21 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 }
 
 func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE / 4 {
+	if updated.nbytes() > BTREE_NODE_SIZE / 4 {
 		return 0, BNode{}
 	}
 
 	if index > 0 {
 		sibling := tree.get(node.getPtr(index - 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged < BTREE_PAGE_SIZE {
+		if merged < BTREE_NODE_SIZE {
 			return -1, sibling
 		}
 	}
 	if index < node.nkeys() - 1 {
 		sibling := tree.get(node.getPtr(index + 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged < BTREE_PAGE_SIZE {
+		if merged < BTREE_NODE_SIZE {
 			return 1, sibling
 		}
 	}
@@ -260,27 +361,33 @@ func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNo
 }
 
 func nodeSplit2(left BNode, right BNode, old BNode) {
-	last := old.nkeys() - 1
-	lastOffset := old.getOffset(last)
-	for i := last; i >= 0; i-- {
-		
-		offset := HEADER + (old.nkeys() - i) * 6 + (lastOffset - old.getOffset(i))
-		if offset > BTREE_PAGE_SIZE {
-			break;
-		}
-		
-		last = i;
+	nkeys := old.nkeys()
+	leftBytes := func(n uint16) uint16 {
+		return HEADER + n * 10 + old.getOffset(n)
+	}
+	rightBytes := func(n uint16) uint16 {
+		return HEADER + (nkeys - n) * 10 + old.getOffset(nkeys) - old.getOffset(n)
+	}
+
+	// split in the middle, the right half always has to fit a page
+	last := uint16(1)
+	for last < nkeys - 1 && leftBytes(last) < old.nbytes() / 2 {
+		last++
+	}
+	for last < nkeys - 1 && rightBytes(last) > BTREE_NODE_SIZE {
+		last++
 	}
+	assert(rightBytes(last) <= BTREE_NODE_SIZE)
 
-	right.setHeader(old.btype(), old.nkeys() - last)
-	nodeAppendRange(right, old, 0, last, old.nkeys() - last)
+	right.setHeader(old.btype(), nkeys - last)
+	nodeAppendRange(right, old, 0, last, nkeys - last)
 
 	left.setHeader(old.btype(), last)
 	nodeAppendRange(left, old, 0, 0, last)
 }
 
 func nodeSplit3(node BNode) (uint16, [3]BNode) {
-	if node.nbytes() <= BTREE_PAGE_SIZE {		
+	if node.nbytes() <= BTREE_NODE_SIZE {		
 		node.data = node.data[:BTREE_PAGE_SIZE]
 		return 1, [3]BNode{ node }
 	}
@@ -288,15 +395,15 @@ func nodeSplit3(node BNode) (uint16, [3]BNode) {
 	left := BNode{make([]byte, 2 * BTREE_PAGE_SIZE)}
 	right := BNode{make([]byte, BTREE_PAGE_SIZE)}	
 	nodeSplit2(left, right, node)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
+	if left.nbytes() <= BTREE_NODE_SIZE {
 		left.data = left.data[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right}
 	}
 	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(leftleft, middle, left)
-	assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
-	return 3, [3]BNode{left, middle, right}
+	assert(leftleft.nbytes() <= BTREE_NODE_SIZE)
+	return 3, [3]BNode{leftleft, middle, right}
 }
 
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, index uint16, kids ...BNode) {
@@ -304,7 +411,7 @@ func nodeReplaceKidN(tree *BTree, new BNode, old BNode, index uint16, kids ...BN
 	new.setHeader(BNODE_NODE, old.nkeys() + n - 1)
 	nodeAppendRange(new, old, 0, 0, index)
 	for i, kid := range kids {
-		nodeAppendKV(new, index + uint16(i), tree.new(kid), old.getKey(0), nil)
+		nodeAppendKV(new, index + uint16(i), tree.new(kid), kid.getKey(0), nil)
 	}
 
 	nodeAppendRange(new, old, index + n, index + 1, old.nkeys() - (index + 1))
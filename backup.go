@@ -0,0 +1,244 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Backup writes a copy of the last commit to `w` that opens as a
+// database file. Only the pages of the trees are copied, numbered
+// from the start of the file, so the copy has no free pages. Writers
+// go on in the meantime, the pages of the copied commit are kept until
+// it returns, which has to be before `Close`. The copy is encrypted
+// with the key of the database. It can't start a chain of incremental
+// backups, see `KV.BackupSince`.
+func (db *KV) Backup(w io.Writer) error {
+	if err := backup(db, w); err != nil {
+		return fmt.Errorf("KV.Backup: %w", err)
+	}
+	return nil
+}
+
+// a commit being copied by `KV.Backup`
+type snapshot struct {
+	db *KV
+	w io.Writer
+	root, meta, version uint64
+	free, pending uint64 // heads of the lists
+	npages uint64 // of the file at `version`
+	// copies of the pages of the free and pending lists if not nil,
+	// they change in place
+	lists map[uint64][]byte
+	locked bool // `db.mu` is held for the whole copy
+	next uint64 // number of the next page written
+}
+
+func backup(db *KV, w io.Writer) error {
+	snap := &snapshot{db: db, w: w}
+	unpin, err := snapshotPin(snap)
+	if err != nil {
+		return err
+	}
+	defer unpin()
+
+	// the roots come last in their trees
+	ntree := snap.count(snap.root, snap.height(snap.root), false)
+	nmeta := snap.count(snap.meta, snap.height(snap.meta), true)
+	fields := []uint64{0, 1 + ntree + nmeta, 0, snap.version, 0, 0}
+	if snap.root != 0 {
+		fields[MASTER_ROOT] = ntree
+	}
+	if snap.meta != 0 {
+		fields[MASTER_META] = ntree + nmeta
+	}
+	master := make([]byte, BTREE_PAGE_SIZE)
+	data := masterPack(fields)
+	copy(master, data[:])
+	if db.crypt != nil {
+		copy(master[KEY_CHECK_OFFSET:], db.crypt.check[:])
+	}
+	if err := snap.write(master); err != nil {
+		return err
+	}
+
+	if _, err := snap.copy(snap.root, false); err != nil {
+		return err
+	}
+	if _, err := snap.copy(snap.meta, true); err != nil {
+		return err
+	}
+	assert(snap.next == 1 + ntree + nmeta)
+	return nil
+}
+
+// take the last commit and keep its pages until `unpin`
+func snapshotPin(snap *snapshot) (unpin func(), err error) {
+	db := snap.db
+	if db.readers != nil && db.opts.ReadOnly {
+		// the writer is another process and keeps the pinned commit,
+		// only the readers of this one wait
+		db.mu.Lock()
+		if !readerPin(db) {
+			db.mu.Unlock()
+			return nil, ErrNothingCommitted
+		}
+		snap.locked = true
+		snapshotTake(snap)
+		return func() {
+			readerUnpin(db)
+			db.mu.Unlock()
+		}, nil
+	}
+	if readOnly(db) {
+		// nothing writes but the primary of a follower, which waits.
+		// The commits of the WAL are in `page.updates`.
+		db.mu.RLock()
+		snap.locked = true
+		snapshotTake(snap)
+		return db.mu.RUnlock, nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.wal.fp != nil {
+		// the WAL commits are only in the pages after a checkpoint
+		if err := checkpoint(db); err != nil {
+			return nil, err
+		}
+	}
+	snapshotTake(snap)
+	db.backups = append(db.backups, snap.version)
+	return func() { backupUnpin(db, snap.version) }, nil
+}
+
+func snapshotTake(snap *snapshot) {
+	db := snap.db
+	snap.root = db.tree.root
+	snap.meta = db.meta.root
+	snap.version = db.version
+	snap.free = db.free.head
+	snap.pending = db.pending
+	snap.npages = db.page.flushed + uint64(db.page.nappend)
+	if snap.lists == nil {
+		return
+	}
+	for _, head := range []uint64{db.free.head, db.pending} {
+		for next := head; next != 0; {
+			node := db.pageGet(next)
+			page := make([]byte, BTREE_PAGE_SIZE)
+			copy(page, node.data)
+			snap.lists[next] = page
+			next = flnNext(node)
+		}
+	}
+}
+
+func backupUnpin(db *KV, version uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, pinned := range db.backups {
+		if pinned == version {
+			db.backups = append(db.backups[:i], db.backups[i + 1:]...)
+			break
+		}
+	}
+}
+
+// a copy of page `ptr`, writers only wait for a single page. They
+// may have newer pages in `page.updates` then.
+func (snap *snapshot) page(ptr uint64) BNode {
+	db := snap.db
+	node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	if snap.locked {
+		copy(node.data, db.pageGet(ptr).data)
+		return node
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	copy(node.data, db.pager.Page(ptr))
+	return node
+}
+
+// levels of the tree at `ptr`, all its leaves are at the bottom
+func (snap *snapshot) height(ptr uint64) int {
+	if ptr == 0 {
+		return 0
+	}
+	height := 1
+	for node := snap.page(ptr); node.btype() == BNODE_NODE; node = snap.page(node.getPtr(0)) {
+		height++
+	}
+	return height
+}
+
+// pages of the tree at `ptr`, with the bucket trees below the leaves of
+// the meta tree. The other leaves are not read.
+func (snap *snapshot) count(ptr uint64, height int, meta bool) uint64 {
+	if ptr == 0 {
+		return 0
+	}
+	if height == 1 && !meta {
+		return 1
+	}
+	node := snap.page(ptr)
+	n := uint64(1)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			n += snap.count(node.getPtr(i), height - 1, meta)
+		}
+	} else {
+		for _, i := range catalogRoots(node) {
+			stored, _ := node.getStored(i)
+			root := binary.LittleEndian.Uint64(stored)
+			n += snap.count(root, snap.height(root), false)
+		}
+	}
+	return n
+}
+
+// write the tree at `ptr` children first, like `count` counts it, and
+// return the new number of its root
+func (snap *snapshot) copy(ptr uint64, meta bool) (uint64, error) {
+	if ptr == 0 {
+		return 0, nil
+	}
+	node := snap.page(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid, err := snap.copy(node.getPtr(i), meta)
+			if err != nil {
+				return 0, err
+			}
+			node.setPtr(i, kid)
+		}
+	} else if meta {
+		for _, i := range catalogRoots(node) {
+			stored, _ := node.getStored(i)
+			root, err := snap.copy(binary.LittleEndian.Uint64(stored), false)
+			if err != nil {
+				return 0, err
+			}
+			binary.LittleEndian.PutUint64(stored, root)
+		}
+	}
+	ptr = snap.next
+	return ptr, snap.write(node.data)
+}
+
+// write the next page of the copy, sealed like `cryptFile` does
+func (snap *snapshot) write(page []byte) error {
+	ptr := snap.next
+	if pc := snap.db.crypt; pc != nil && ptr > 0 {
+		sealed, err := cryptSeal(pc, nil, page[:BTREE_NODE_SIZE], cryptPageAD(ptr))
+		if err != nil {
+			return err
+		}
+		page = sealed
+	}
+	if _, err := snap.w.Write(page); err != nil {
+		return err
+	}
+	snap.next++
+	return nil
+}
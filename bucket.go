@@ -0,0 +1,213 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const BUCKET_MAX_NAME_SIZE = 255
+
+var ErrBucketExists = errors.New("bucket already exists")
+var ErrBucketNotFound = errors.New("bucket not found")
+
+// Bucket is a keyspace of its own with a tree of its own. Outside a
+// transaction every change is a commit of its own.
+type Bucket struct {
+	db *KV
+	tx *Tx // the transaction the bucket was opened in, or nil
+	name string
+}
+
+func (db *KV) CreateBucket(name string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.CreateBucket(name)
+	})
+}
+
+func (db *KV) Bucket(name string) (*Bucket, error) {
+	err := db.View(func(tx *Tx) error {
+		_, err := tx.Bucket(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, name: name}, nil
+}
+
+func (db *KV) DropBucket(name string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DropBucket(name)
+	})
+}
+
+func (db *KV) ListBuckets() ([]string, error) {
+	var names []string
+	err := db.View(func(tx *Tx) error {
+		names = tx.ListBuckets()
+		return nil
+	})
+	return names, err
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// the value is a copy outside a transaction
+func (b *Bucket) Get(key []byte) ([]byte, bool) {
+	if b.tx != nil {
+		val, ok, _ := b.tx.get(b.name, key)
+		return val, ok
+	}
+	var val []byte
+	var ok bool
+	_ = b.db.View(func(tx *Tx) error {
+		val, ok, _ = tx.get(b.name, key)
+		val = append([]byte{}, val...)
+		return nil
+	})
+	return val, ok
+}
+
+func (b *Bucket) Set(key []byte, val []byte) error {
+	if b.tx != nil {
+		return b.tx.set(b.name, key, val, 0)
+	}
+	return b.db.Update(func(tx *Tx) error {
+		return tx.set(b.name, key, val, 0)
+	})
+}
+
+func (b *Bucket) Del(key []byte) (bool, error) {
+	if b.tx != nil {
+		return b.tx.del(b.name, key)
+	}
+	deleted := false
+	err := b.db.Update(func(tx *Tx) error {
+		var err error
+		deleted, err = tx.del(b.name, key)
+		return err
+	})
+	return deleted, err
+}
+
+// Scan is like `KV.Scan` in the bucket.
+func (b *Bucket) Scan(start []byte, fn func(key []byte, val []byte) bool) error {
+	if b.tx != nil {
+		return b.tx.scan(b.name, start, fn)
+	}
+	return b.db.View(func(tx *Tx) error {
+		return tx.scan(b.name, start, fn)
+	})
+}
+
+func bucketCheckName(name string) error {
+	if name == "" || len(name) > BUCKET_MAX_NAME_SIZE {
+		return fmt.Errorf("bucket name has %d bytes, not 1 to %d", len(name), BUCKET_MAX_NAME_SIZE)
+	}
+	return nil
+}
+
+// catalog entry of a bucket in the meta tree
+// | 'b' | name | -> | root |
+// | 1B  |  ... |    |  8B  |
+func bucketKey(name string) []byte {
+	return metaKey(META_BUCKET, []byte(name))
+}
+
+func bucketRoot(db *KV, name string) (uint64, bool) {
+	val, ok := db.meta.Get(bucketKey(name))
+	if !ok {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(val), true
+}
+
+func bucketStore(db *KV, name string, root uint64) {
+	var val [8]byte
+	binary.LittleEndian.PutUint64(val[:], root)
+	db.meta.Insert(bucketKey(name), val[:])
+}
+
+func bucketTree(db *KV, root uint64) BTree {
+	return BTree{
+		root: root, get: db.pageGet, new: db.pageNew, del: db.pageDel,
+		pin: db.pagePin, unpin: db.pageUnpin, corrupt: db.valueCorrupt,
+	}
+}
+
+func bucketNames(db *KV) []string {
+	names := []string{}
+	db.meta.Scan(bucketKey(""), func(key []byte, _ []byte) bool {
+		if key[0] != META_BUCKET {
+			return false
+		}
+		names = append(names, string(key[1:]))
+		return true
+	})
+	return names
+}
+
+// free every page of a tree
+func treeFree(db *KV, ptr uint64) {
+	node := db.pageGet(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeFree(db, node.getPtr(i))
+		}
+	}
+	db.pageDel(ptr)
+}
+
+// apply a change of a transaction or of the WAL. The changes of a WAL
+// record may be applied twice, so creating a bucket that exists and
+// changing one that doesn't do nothing.
+func applyOp(db *KV, op txOp) {
+	if op.bucket == "" {
+		switch op.code {
+		case WAL_OP_SET:
+			applySet(db, op.key, op.val, op.vflags)
+		case WAL_OP_DEL:
+			applyDel(db, op.key)
+		}
+		return
+	}
+
+	root, ok := bucketRoot(db, op.bucket)
+	switch op.code {
+	case WAL_OP_CREATE_BUCKET:
+		if !ok {
+			bucketStore(db, op.bucket, 0)
+		}
+		return
+	case WAL_OP_DROP_BUCKET:
+		if ok {
+			if root != 0 {
+				treeFree(db, root)
+			}
+			db.meta.Delete(bucketKey(op.bucket))
+		}
+		return
+	}
+	if !ok {
+		return
+	}
+	tree := bucketTree(db, root)
+	old, oflags := watchOld(db, &tree, op.key)
+	switch op.code {
+	case WAL_OP_SET:
+		tree.insert(op.key, op.val, op.vflags)
+		recordChange(db, op.bucket, op.key, old, oflags, op.val, op.vflags, ChangeSet)
+	case WAL_OP_DEL:
+		if tree.Delete(op.key) {
+			recordChange(db, op.bucket, op.key, old, oflags, nil, 0, ChangeDel)
+		} else {
+			changeSkip(db)
+		}
+	}
+	if tree.root != root {
+		bucketStore(db, op.bucket, tree.root)
+	}
+}
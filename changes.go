@@ -0,0 +1,174 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// the low bits of a sequence number count the changes of a commit
+const CHANGE_SEQ_BITS = 24
+// changes returned by one call of `KV.Changes`
+const CHANGES_BATCH = 1000
+// changes deleted by one commit of `KV.TrimChanges`
+const CHANGES_TRIM_BATCH = 1000
+
+// changelog entry in the meta tree, split in parts that fit a value
+// | 'c' | seq | part | -> | op | blen | bucket | klen | key | vflags | value |
+// | 1B  | 8B  |  1B  |    | 1B |  1B  |  ...   |  2B  | ... |   2B   |  ...  |
+// `seq` is the version of the commit above CHANGE_SEQ_BITS and the
+// number of the change in the commit below, so a WAL record replayed
+// twice writes the same entries. The value is as stored.
+func changeKey(seq uint64, part byte) []byte {
+	var be [8]byte
+	binary.BigEndian.PutUint64(be[:], seq)
+	return metaKey(META_CHANGES, be[:], []byte{part})
+}
+
+// number the changes from here on as those of commit `version`, and
+// log them if `on`
+func changesBegin(db *KV, version uint64, on bool) {
+	db.changes.version = version
+	db.changes.next = 0
+	db.changes.on = on
+}
+
+// a delete of a missing key logs nothing but takes its number, so a
+// WAL record replayed over its own result numbers the changes the same
+func changeSkip(db *KV) {
+	db.changes.next++
+}
+
+func changeLog(db *KV, bucket string, key []byte, val []byte, vflags uint16, op ChangeOp) {
+	assert(db.changes.next < 1 << CHANGE_SEQ_BITS)
+	seq := db.changes.version << CHANGE_SEQ_BITS | db.changes.next
+	db.changes.next++
+
+	record := []byte{byte(op), byte(len(bucket))}
+	record = append(record, bucket...)
+	record = binary.LittleEndian.AppendUint16(record, uint16(len(key)))
+	record = append(record, key...)
+	record = binary.LittleEndian.AppendUint16(record, vflags)
+	record = append(record, val...)
+	for part := 0; len(record) > 0; part++ {
+		n := min(len(record), BTREE_MAX_VAL_SIZE)
+		db.meta.Insert(changeKey(seq, byte(part)), record[:n])
+		record = record[n:]
+	}
+}
+
+func changeDecode(seq uint64, record []byte) (Change, error) {
+	bad := errors.New("bad changelog entry")
+	if len(record) < 2 || len(record) < 2 + int(record[1]) + 2 {
+		return Change{}, bad
+	}
+	change := Change{Seq: seq, Commit: seq >> CHANGE_SEQ_BITS, Op: ChangeOp(record[0])}
+	change.Bucket = string(record[2 : 2 + record[1]])
+	record = record[2 + record[1]:]
+	klen := int(binary.LittleEndian.Uint16(record))
+	if len(record) < 2 + klen + 2 {
+		return Change{}, bad
+	}
+	change.Key = append([]byte{}, record[2 : 2 + klen]...)
+	record = record[2 + klen:]
+	if change.Op == ChangeSet {
+		vflags := binary.LittleEndian.Uint16(record)
+		val, err := valueLogical(record[2:], vflags)
+		if err != nil {
+			return Change{}, err
+		}
+		change.New = append([]byte{}, val...)
+	}
+	return change, nil
+}
+
+// Changes returns the logged changes from sequence number `fromSeq`
+// on, in order and at most CHANGES_BATCH of them. A consumer goes on
+// from the `Seq` of the last one plus one, which it can save to resume
+// after a restart. Changes are logged with `OpenOptions.ChangeLog`,
+// without their old value.
+func (db *KV) Changes(fromSeq uint64) ([]Change, error) {
+	changes := []Change{}
+	err := db.View(func(tx *Tx) error {
+		var record []byte
+		seq := uint64(0)
+		var err error
+		flush := func() {
+			if record != nil && err == nil {
+				var change Change
+				change, err = changeDecode(seq, record)
+				changes = append(changes, change)
+			}
+		}
+		db.meta.Scan(changeKey(fromSeq, 0), func(key []byte, val []byte) bool {
+			if key[0] != META_CHANGES {
+				return false
+			}
+			if key[1 + 8] == 0 {
+				flush()
+				if len(changes) == CHANGES_BATCH || err != nil {
+					record = nil
+					return false
+				}
+				seq = binary.BigEndian.Uint64(key[1:])
+				record = nil
+			}
+			record = append(record, val...)
+			return true
+		})
+		flush()
+		return err
+	})
+	if errors.Is(err, ErrNothingCommitted) {
+		return changes, nil
+	}
+	return changes, err
+}
+
+// TrimChanges deletes the logged changes up to sequence number
+// `uptoSeq`, in commits of CHANGES_TRIM_BATCH changes.
+func (db *KV) TrimChanges(uptoSeq uint64) error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	for {
+		req := commitReq{trim: true, trimSeq: uptoSeq}
+		groupCommit(db, &req)
+		if req.err != nil {
+			return req.err
+		}
+		if req.trimmed < CHANGES_TRIM_BATCH {
+			return nil
+		}
+	}
+}
+
+// delete up to `limit` changes up to `upto`, all of them if it is 0.
+// Returns the number deleted and the last one, which is all a replay
+// of the WAL needs.
+func changesTrim(db *KV, upto uint64, limit int) (int, uint64) {
+	keys := [][]byte{}
+	n := 0
+	last := uint64(0)
+	db.meta.Scan(changeKey(0, 0), func(key []byte, _ []byte) bool {
+		if key[0] != META_CHANGES {
+			return false
+		}
+		seq := binary.BigEndian.Uint64(key[1:])
+		if seq > upto {
+			return false
+		}
+		if key[1 + 8] == 0 {
+			if limit > 0 && n == limit {
+				return false
+			}
+			n++
+			last = seq
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true
+	})
+	for _, key := range keys {
+		db.meta.Delete(key)
+	}
+	return n, last
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/theakula/pandora_db"
+)
+
+// how the CSV columns map to keys and values
+type csvMapping struct {
+	keyColumns []string // joined with keySep into the key
+	keySep string
+	value string // "json" for an object of the other columns, "raw" for one column
+	valueColumn string
+	comma rune
+	bucket string // outside buckets if empty
+}
+
+func csvFlags(flags *flag.FlagSet) (*csvMapping, func() []byte) {
+	m := &csvMapping{}
+	key := keyFlag(flags, "key", "PANDORA_KEY", "key")
+	flags.Func("key-columns", "columns of the key, separated by commas, the first one by default", func(s string) error {
+		m.keyColumns = strings.Split(s, ",")
+		return nil
+	})
+	flags.StringVar(&m.keySep, "key-sep", ":", "separator between the key columns in the key")
+	flags.StringVar(&m.value, "value", "json", "value encoding: json or raw")
+	flags.StringVar(&m.valueColumn, "value-column", "", "column of a raw value")
+	flags.Func("comma", "field delimiter, ',' by default", func(s string) error {
+		r, size := utf8.DecodeRuneInString(s)
+		if size != len(s) || r == utf8.RuneError {
+			return errors.New("not a single character")
+		}
+		m.comma = r
+		return nil
+	})
+	flags.StringVar(&m.bucket, "bucket", "", "bucket of the keys, none if empty")
+	m.comma = ','
+	return m, key
+}
+
+// the position of every column in `names`
+func csvIndex(header []string, names []string) ([]int, error) {
+	index := []int{}
+	for _, name := range names {
+		i := 0
+		for i < len(header) && header[i] != name {
+			i++
+		}
+		if i == len(header) {
+			return nil, fmt.Errorf("no column %q", name)
+		}
+		index = append(index, i)
+	}
+	return index, nil
+}
+
+// a JSON object of the values in `row` that are not in `skip`, in
+// the order of the columns
+func csvObject(header []string, row []string, skip map[int]bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range row {
+		if skip[i] {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(header[i])
+		val, _ := json.Marshal(field)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+type csvRow struct {
+	key, val []byte
+}
+
+func importCSV(args []string) {
+	flags := flag.NewFlagSet("import-csv", flag.ExitOnError)
+	m, key := csvFlags(flags)
+	compression := flags.String("compression", "", "codec of the values, none if empty")
+	batch := flags.Int("batch", 1000, "rows per transaction")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 || *batch < 1 {
+		usage()
+	}
+
+	in := os.Stdin
+	if flags.NArg() == 2 {
+		var err error
+		if in, err = os.Open(flags.Arg(1)); err != nil {
+			fail(err)
+		}
+		defer in.Close()
+	}
+	r := csv.NewReader(in)
+	r.Comma = m.comma
+	header, err := r.Read()
+	if err != nil {
+		fail(fmt.Errorf("header: %w", err))
+	}
+	if m.keyColumns == nil {
+		m.keyColumns = header[:1]
+	}
+	keys, err := csvIndex(header, m.keyColumns)
+	if err != nil {
+		fail(err)
+	}
+	skip := map[int]bool{}
+	for _, i := range keys {
+		skip[i] = true
+	}
+	raw := -1
+	switch m.value {
+	case "json":
+	case "raw":
+		rest := []int{}
+		if m.valueColumn != "" {
+			index, err := csvIndex(header, []string{m.valueColumn})
+			if err != nil {
+				fail(err)
+			}
+			rest = index
+		} else {
+			for i := range header {
+				if !skip[i] {
+					rest = append(rest, i)
+				}
+			}
+		}
+		if len(rest) != 1 {
+			fail(errors.New("a raw value needs -value-column"))
+		}
+		raw = rest[0]
+	default:
+		usage()
+	}
+
+	db, err := pandora_db.Open(flags.Arg(0), &pandora_db.OpenOptions{
+		CreateIfMissing: true,
+		EncryptionKey: key(),
+		Compression: *compression,
+	})
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+	if m.bucket != "" {
+		err := db.CreateBucket(m.bucket)
+		if err != nil && !errors.Is(err, pandora_db.ErrBucketExists) {
+			fail(err)
+		}
+	}
+
+	rows := []csvRow{}
+	imported, bad := 0, 0
+	flush := func() {
+		err := db.Update(func(tx *pandora_db.Tx) error {
+			set := tx.Set
+			if m.bucket != "" {
+				b, err := tx.Bucket(m.bucket)
+				if err != nil {
+					return err
+				}
+				set = b.Set
+			}
+			for _, row := range rows {
+				if err := set(row.key, row.val); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Errorf("after %d rows: %w", imported, err))
+		}
+		imported += len(rows)
+		rows = rows[:0]
+	}
+	// a malformed row is reported and skipped
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := r.FieldPos(0)
+		if err == nil {
+			var val []byte
+			if raw >= 0 {
+				val = []byte(row[raw])
+			} else {
+				val = csvObject(header, row, skip)
+			}
+			parts := []string{}
+			for _, i := range keys {
+				parts = append(parts, row[i])
+			}
+			k := []byte(strings.Join(parts, m.keySep))
+			switch {
+			case len(k) == 0 || len(k) > pandora_db.BTREE_MAX_KEY_SIZE:
+				err = fmt.Errorf("key has %d bytes, not 1 to %d", len(k), pandora_db.BTREE_MAX_KEY_SIZE)
+			case len(val) > pandora_db.BTREE_MAX_VAL_SIZE:
+				err = fmt.Errorf("value has %d bytes, more than %d", len(val), pandora_db.BTREE_MAX_VAL_SIZE)
+			default:
+				rows = append(rows, csvRow{k, val})
+			}
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				line = perr.Line
+				err = perr.Err
+			}
+			fmt.Fprintf(os.Stderr, "pandora: line %d: %v\n", line, err)
+			bad++
+		}
+		if len(rows) == *batch {
+			flush()
+		}
+	}
+	flush()
+	fmt.Fprintf(os.Stderr, "pandora: imported %d rows, skipped %d\n", imported, bad)
+}
+
+// the fields of a JSON object in order, strings without their quotes
+func jsonFields(data []byte) ([]string, []string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, errors.New("value is not a JSON object")
+	}
+	names, vals := []string{}, []string{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		val := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			val = s
+		}
+		names = append(names, tok.(string))
+		vals = append(vals, val)
+	}
+	return names, vals, nil
+}
+
+func exportCSV(args []string) {
+	flags := flag.NewFlagSet("export-csv", flag.ExitOnError)
+	m, key := csvFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usage()
+	}
+	if m.keyColumns == nil {
+		m.keyColumns = []string{"key"}
+	}
+	if m.valueColumn == "" {
+		m.valueColumn = "value"
+	}
+	if m.value != "json" && m.value != "raw" {
+		usage()
+	}
+
+	db, err := pandora_db.Open(flags.Arg(0), &pandora_db.OpenOptions{
+		ReadOnly: true, EncryptionKey: key(),
+	})
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+	out := os.Stdout
+	if flags.NArg() == 2 {
+		if out, err = os.Create(flags.Arg(1)); err != nil {
+			fail(err)
+		}
+	}
+	w := csv.NewWriter(out)
+	w.Comma = m.comma
+
+	// the columns of a JSON value are those of the first one
+	var columns []string
+	exported, bad := 0, 0
+	row := func(k []byte, v []byte) bool {
+		fields := strings.Split(string(k), m.keySep)
+		if len(fields) != len(m.keyColumns) {
+			fmt.Fprintf(os.Stderr, "pandora: key %q: %d columns, not %d\n", k, len(fields), len(m.keyColumns))
+			bad++
+			return true
+		}
+		if m.value == "raw" {
+			fields = append(fields, string(v))
+		} else {
+			names, vals, err := jsonFields(v)
+			if err == nil && columns == nil {
+				columns = names
+				w.Write(append(append([]string{}, m.keyColumns...), columns...))
+			}
+			if err == nil && strings.Join(names, "\x00") != strings.Join(columns, "\x00") {
+				err = errors.New("value has other columns than the first one")
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "pandora: key %q: %v\n", k, err)
+				bad++
+				return true
+			}
+			fields = append(fields, vals...)
+		}
+		w.Write(fields)
+		exported++
+		return true
+	}
+	if m.value == "raw" {
+		w.Write(append(append([]string{}, m.keyColumns...), m.valueColumn))
+	}
+	if m.bucket != "" {
+		b, err := db.Bucket(m.bucket)
+		if err == nil {
+			err = b.Scan(nil, row)
+		}
+		if err != nil {
+			fail(err)
+		}
+	} else {
+		db.Scan(nil, row)
+	}
+	w.Flush()
+	err = w.Error()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "pandora: exported %d rows, skipped %d\n", exported, bad)
+}
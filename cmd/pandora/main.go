@@ -0,0 +1,204 @@
+// Command pandora works on database files.
+//
+//	pandora rekey [-old-key-file FILE] [-new-key-file FILE] PATH
+//	pandora restore PATH FULL [INCREMENTAL...]
+//	pandora dump [-key-file FILE] PATH [OUT]
+//	pandora load [-key-file FILE] [-compression NAME] PATH [IN]
+//	pandora import-csv [-key-file FILE] [-compression NAME] [-batch N] [CSV FLAGS] PATH [IN]
+//	pandora export-csv [-key-file FILE] [CSV FLAGS] PATH [OUT]
+//
+// Keys are AES keys of 16, 24 or 32 bytes written in hex, read from
+// the file of -key-file or else from $PANDORA_KEY, so that they don't
+// show up in the process list. Rekey reads the current key from
+// -old-key-file or $PANDORA_OLD_KEY and the new one from -new-key-file
+// or $PANDORA_NEW_KEY. A missing key means no encryption.
+//
+// Restore makes the database at PATH from files written by
+// KV.BackupSince, a full backup first. Dump and load go through the
+// format of KV.Dump, standard output and input by default, load
+// creates the database if needed.
+//
+// The CSV files have a header. The columns named by -key-columns,
+// joined with -key-sep, make the key. With -value json the value is a
+// JSON object of the other columns, with -value raw it is the single
+// other column or -value-column. Export splits the keys and values
+// back, the columns of JSON values are those of the first one.
+// Malformed rows are reported and skipped, import commits every -batch
+// rows.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/theakula/pandora_db"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pandora rekey [-old-key-file FILE] [-new-key-file FILE] PATH")
+	fmt.Fprintln(os.Stderr, "       pandora restore PATH FULL [INCREMENTAL...]")
+	fmt.Fprintln(os.Stderr, "       pandora dump [-key-file FILE] PATH [OUT]")
+	fmt.Fprintln(os.Stderr, "       pandora load [-key-file FILE] [-compression NAME] PATH [IN]")
+	fmt.Fprintln(os.Stderr, "       pandora import-csv [-key-file FILE] [-compression NAME] [-batch N] [CSV FLAGS] PATH [IN]")
+	fmt.Fprintln(os.Stderr, "       pandora export-csv [-key-file FILE] [CSV FLAGS] PATH [OUT]")
+	fmt.Fprintln(os.Stderr, "CSV flags: [-key-columns NAMES] [-key-sep SEP] [-value json|raw]")
+	fmt.Fprintln(os.Stderr, "           [-value-column NAME] [-comma CHAR] [-bucket NAME]")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "pandora:", err)
+	os.Exit(1)
+}
+
+func parseKey(name string, text string) []byte {
+	if text == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		fail(fmt.Errorf("%s: %w", name, err))
+	}
+	return key
+}
+
+// a `-NAME-file` flag for a key, which falls back to `$env`. Keys are
+// never taken from the command line, where other users can see them.
+func keyFlag(flags *flag.FlagSet, name string, env string, what string) func() []byte {
+	usage := fmt.Sprintf("file of the %s in hex, $%s if not set, none if neither", what, env)
+	file := flags.String(name + "-file", "", usage)
+	return func() []byte {
+		text := os.Getenv(env)
+		if *file != "" {
+			data, err := os.ReadFile(*file)
+			if err != nil {
+				fail(err)
+			}
+			text = strings.TrimSpace(string(data))
+		}
+		return parseKey(name, text)
+	}
+}
+
+func rekey(args []string) {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	oldKey := keyFlag(flags, "old-key", "PANDORA_OLD_KEY", "current key")
+	newKey := keyFlag(flags, "new-key", "PANDORA_NEW_KEY", "new key")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	err := pandora_db.Rekey(flags.Arg(0), oldKey(), newKey())
+	if err != nil {
+		fail(err)
+	}
+}
+
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		usage()
+	}
+
+	backups := []io.Reader{}
+	for _, name := range flags.Args()[1:] {
+		fp, err := os.Open(name)
+		if err != nil {
+			fail(err)
+		}
+		defer fp.Close()
+		backups = append(backups, bufio.NewReader(fp))
+	}
+	if err := pandora_db.Restore(flags.Arg(0), backups...); err != nil {
+		fail(err)
+	}
+}
+
+func dump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	key := keyFlag(flags, "key", "PANDORA_KEY", "key")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usage()
+	}
+
+	db, err := pandora_db.Open(flags.Arg(0), &pandora_db.OpenOptions{
+		ReadOnly: true, EncryptionKey: key(),
+	})
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+	out := os.Stdout
+	if flags.NArg() == 2 {
+		if out, err = os.Create(flags.Arg(1)); err != nil {
+			fail(err)
+		}
+	}
+	err = db.Dump(out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func load(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	key := keyFlag(flags, "key", "PANDORA_KEY", "key")
+	compression := flags.String("compression", "", "codec of the new values, none if empty")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usage()
+	}
+
+	db, err := pandora_db.Open(flags.Arg(0), &pandora_db.OpenOptions{
+		CreateIfMissing: true,
+		EncryptionKey: key(),
+		Compression: *compression,
+	})
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+	in := os.Stdin
+	if flags.NArg() == 2 {
+		if in, err = os.Open(flags.Arg(1)); err != nil {
+			fail(err)
+		}
+		defer in.Close()
+	}
+	if err := db.Load(in); err != nil {
+		fail(err)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "rekey":
+		rekey(os.Args[2:])
+	case "restore":
+		restore(os.Args[2:])
+	case "dump":
+		dump(os.Args[2:])
+	case "load":
+		load(os.Args[2:])
+	case "import-csv":
+		importCSV(os.Args[2:])
+	case "export-csv":
+		exportCSV(os.Args[2:])
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,111 @@
+package pandora_db
+
+import "fmt"
+
+// a single Set or Del, or a transaction, waiting for its commit
+type commitReq struct {
+	key []byte
+	val []byte // as stored, see `valueEncode`
+	vflags uint16
+	del bool
+	sweep bool // delete expired keys, see `ttlSweep`
+	update func(*Tx) error // a transaction of `KV.Update`
+	trim bool // delete logged changes up to `trimSeq`, see `changesTrim`
+	trimSeq uint64
+
+	deleted bool // result of a Del
+	swept [][]byte // keys deleted by a sweep
+	ops []txOp // changes made by the transaction
+	trimmed int
+	err error
+	wake chan bool // true to lead the next batch, false when done
+}
+
+// Writers queue up their changes and the first one in the queue
+// commits everything queued so far with one flush, then hands the
+// lead over to the next writer that arrived in the meantime. The
+// changes of a batch are independent, they are applied in order and
+// share the result of the flush.
+func groupCommit(db *KV, req *commitReq) {
+	req.wake = make(chan bool, 1)
+
+	db.group.mu.Lock()
+	db.group.reqs = append(db.group.reqs, req)
+	lead := !db.group.busy
+	db.group.busy = true
+	db.group.mu.Unlock()
+
+	if !lead && !<-req.wake {
+		return
+	}
+
+	db.mu.Lock()
+	db.group.mu.Lock()
+	batch := db.group.reqs
+	db.group.reqs = nil
+	db.group.mu.Unlock()
+
+	err := commitBatch(db, batch)
+	watchEnd(db, err)
+	db.mu.Unlock()
+
+	db.group.mu.Lock()
+	if len(db.group.reqs) > 0 {
+		db.group.reqs[0].wake <- true
+	} else {
+		db.group.busy = false
+	}
+	db.group.mu.Unlock()
+
+	for _, r := range batch {
+		if r.err == nil {
+			r.err = err // a failed transaction changed nothing
+		}
+		if r != req {
+			r.wake <- false
+		}
+	}
+}
+
+// apply the changes of a batch and commit them. A page that can't be
+// read fails the batch, any other panic fails every write from then
+// on. Either way the batch is rolled back and the leader goes on to
+// unlock and hand over the lead.
+func commitBatch(db *KV, batch []*commitReq) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if perr, ok := r.(*pageReadError); ok {
+			err = perr
+		} else {
+			db.fatal = fmt.Errorf("commit: panic: %v", r)
+			err = db.fatal
+		}
+		rollback(db)
+	}()
+
+	pendingRelease(db)
+	watchBegin(db)
+	changesBegin(db, db.version + 1, db.opts.ChangeLog)
+	for _, r := range batch {
+		switch {
+		case r.update != nil:
+			r.ops, r.err = txRun(db, r.update)
+		case r.sweep:
+			r.swept = ttlSweep(db)
+		case r.trim:
+			r.trimmed, r.trimSeq = changesTrim(db, r.trimSeq, CHANGES_TRIM_BATCH)
+		case r.del:
+			r.deleted = applyDel(db, r.key)
+		default:
+			applySet(db, r.key, r.val, r.vflags)
+		}
+	}
+	ttlStart(db)
+	if db.wal.fp != nil {
+		return walCommit(db, batch)
+	}
+	return flushPages(db)
+}
@@ -0,0 +1,267 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+type compactor struct {
+	target uint64 // pages at or above this are moved
+	top uint64 // highest page that stays in place
+	moved []uint64 // pages to be relocated
+	free []uint64 // free pages in ascending order
+}
+
+// Compact moves live pages from the end of the file into free pages
+// at lower addresses and truncates the file. The work is done in
+// steps, each one an ordinary commit, so readers are only blocked
+// for the duration of a single step.
+func (db *KV) Compact() error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	// relocated pages may have to wait for readers before the file
+	// can shrink, so give up only after a few steps without progress
+	for idle := 0; idle < 3; {
+		db.mu.Lock()
+		used := db.page.flushed
+		done, err := compactStep(db)
+		shrunk := db.page.flushed < used
+		db.mu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("KV.Compact: %w", err)
+		}
+		if !done {
+			return nil
+		}
+		if shrunk {
+			idle = 0
+		} else {
+			idle++
+		}
+	}
+	return nil
+}
+
+// one commit of the compaction, returns false if there is nothing to do
+func compactStep(db *KV) (bool, error) {
+	if full, err := beginFullSync(db); err != nil {
+		return false, err
+	} else if full {
+		defer endFullSync(db)
+	}
+	if db.wal.fp != nil {
+		if err := checkpoint(db); err != nil {
+			return false, err
+		}
+	}
+	assert(len(db.page.updates) == 0)
+
+	// settle the pages released since the last commit first
+	pendingRelease(db)
+	if len(db.page.updates) > 0 || len(db.page.released) > 0 {
+		return true, flushPages(db)
+	}
+
+	free, nodes := db.free.List()
+	sort.Slice(free, func(i, j int) bool {
+		return free[i] &^ FREE_LIST_PUNCHED < free[j] &^ FREE_LIST_PUNCHED
+	})
+
+	// pages that readers may still see stay where they are
+	pending := pendingList(db)
+	ntree := db.page.flushed - 1 - uint64(len(free) + len(nodes) + len(pending))
+	c := compactor{target: 1 + ntree}
+	for _, ptr := range pending {
+		if ptr > c.top {
+			c.top = ptr
+		}
+	}
+	if db.tree.root != 0 {
+		compactScan(db, &c, db.tree.root, false)
+	}
+	if db.meta.root != 0 {
+		compactScan(db, &c, db.meta.root, true)
+	}
+	if len(c.moved) > len(free) {
+		return false, nil
+	}
+	c.free = free[:len(c.moved)]
+	rest := free[len(c.moved):]
+	for _, ptr := range c.free {
+		if ptr &^ FREE_LIST_PUNCHED > c.top {
+			c.top = ptr &^ FREE_LIST_PUNCHED
+		}
+	}
+
+	// the old list pages and the relocated pages are still part of the
+	// last commit, they become free only after this one, or once
+	// neither a reader nor the master page on disk refers to them
+	unused := append([]uint64{}, nodes...)
+	parked := []uint64{} // pages for the new pending nodes
+	if deferFree(db) {
+		np := (len(c.moved) + FREE_LIST_CAP - 1) / FREE_LIST_CAP
+		if np > len(rest) {
+			return false, nil
+		}
+		parked, rest = rest[:np], rest[np:]
+		for _, ptrs := range [][]uint64{c.moved, parked} {
+			for _, ptr := range ptrs {
+				if ptr &^ FREE_LIST_PUNCHED > c.top {
+					c.top = ptr &^ FREE_LIST_PUNCHED
+				}
+			}
+		}
+	} else {
+		unused = append(unused, c.moved...)
+	}
+
+	// pick the lowest free pages to hold the new list and drop
+	// everything past the last used page
+	k := 0
+	flushed := uint64(0)
+	content := []uint64{}
+	for {
+		flushed = c.top + 1
+		for _, ptr := range rest[:k] {
+			if ptr &^ FREE_LIST_PUNCHED >= flushed {
+				flushed = (ptr &^ FREE_LIST_PUNCHED) + 1
+			}
+		}
+		content = content[:0]
+		for _, ptrs := range [][]uint64{rest[k:], unused} {
+			for _, ptr := range ptrs {
+				if ptr &^ FREE_LIST_PUNCHED < flushed {
+					content = append(content, ptr)
+				}
+			}
+		}
+		need := (len(content) + FREE_LIST_CAP - 1) / FREE_LIST_CAP
+		if need <= k {
+			break
+		}
+		if need > len(rest) {
+			return false, nil
+		}
+		k = need
+	}
+	if flushed >= db.page.flushed && len(c.moved) == 0 {
+		return false, nil
+	}
+
+	if db.tree.root != 0 {
+		db.tree.root = compactMove(db, &c, db.tree.root, false)
+	}
+	if db.meta.root != 0 {
+		db.meta.root = compactMove(db, &c, db.meta.root, true)
+	}
+	db.free.Reset(content, rest[:k])
+	if deferFree(db) {
+		pendingPush(db, c.moved, db.version + 1, func(node BNode) uint64 {
+			ptr := parked[0]
+			parked = parked[1:]
+			db.pageUse(ptr, node)
+			return ptr &^ FREE_LIST_PUNCHED
+		})
+	}
+	db.page.flushed = flushed
+
+	if err := flushPages(db); err != nil {
+		return false, err
+	}
+
+	size := int(flushed) * BTREE_PAGE_SIZE
+	if size < db.fileSize {
+		if err := db.fp.Truncate(int64(size)); err != nil {
+			return false, fmt.Errorf("truncate: %w", err)
+		}
+		db.fileSize = size
+		if err := db.pager.Resize(int(flushed)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// the roots of the bucket trees in a leaf of the meta tree
+func catalogRoots(node BNode) []uint16 {
+	index := []uint16{}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key := node.getKey(i)
+		if len(key) > 0 && key[0] == META_BUCKET {
+			index = append(index, i)
+		}
+	}
+	return index
+}
+
+// find the pages that have to move: the ones past the target
+// and every parent of a moved page. The leaves of the meta tree are
+// the parents of the bucket trees.
+func compactScan(db *KV, c *compactor, ptr uint64, meta bool) bool {
+	node := db.pageGet(ptr)
+	move := ptr >= c.target
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if compactScan(db, c, node.getPtr(i), meta) {
+				move = true
+			}
+		}
+	} else if meta {
+		for _, i := range catalogRoots(node) {
+			stored, _ := node.getStored(i)
+			root := binary.LittleEndian.Uint64(stored)
+			if root != 0 && compactScan(db, c, root, false) {
+				move = true
+			}
+		}
+	}
+
+	if move {
+		c.moved = append(c.moved, ptr)
+	} else if ptr > c.top {
+		c.top = ptr
+	}
+	return move
+}
+
+// copy the pages found by `compactScan` into the lowest free pages
+func compactMove(db *KV, c *compactor, ptr uint64, meta bool) uint64 {
+	node := db.pageGet(ptr)
+	new := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	copy(new.data, node.data)
+
+	move := ptr >= c.target
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid := node.getPtr(i)
+			if moved := compactMove(db, c, kid, meta); moved != kid {
+				new.setPtr(i, moved)
+				move = true
+			}
+		}
+	} else if meta {
+		for _, i := range catalogRoots(node) {
+			stored, _ := node.getStored(i)
+			root := binary.LittleEndian.Uint64(stored)
+			if root == 0 {
+				continue
+			}
+			if moved := compactMove(db, c, root, false); moved != root {
+				stored, _ := new.getStored(i)
+				binary.LittleEndian.PutUint64(stored, moved)
+				move = true
+			}
+		}
+	}
+	if !move {
+		return ptr
+	}
+
+	dst := c.free[0]
+	c.free = c.free[1:]
+	db.pageUse(dst, new)
+	return dst &^ FREE_LIST_PUNCHED
+}
@@ -0,0 +1,167 @@
+package pandora_db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// a stored value can't be decoded. Get and Scan skip it and the writes
+// fail from then on, see `KV.valueCorrupt`.
+var ErrCorrupt = errors.New("corrupt value")
+
+// Codec compresses values. The id it is registered with is stored
+// next to every value it compressed, so it can't be reused for
+// another codec.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, size int) ([]byte, error)
+}
+
+const CODEC_NONE = 0
+const CODEC_FLATE = 1
+
+// values shorter than this are not worth compressing
+const COMPRESS_MIN_SIZE = 64
+
+var codecs = struct {
+	mu sync.RWMutex
+	byID map[byte]Codec
+	byName map[string]byte
+}{
+	byID: map[byte]Codec{},
+	byName: map[string]byte{},
+}
+
+// RegisterCodec makes `codec` available as `OpenOptions.Compression`
+// and to `KV.SetCompressed` under `name`. Call it before opening a
+// database that has values compressed with it.
+func RegisterCodec(id byte, name string, codec Codec) {
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+	if _, ok := codecs.byID[id]; ok || id == CODEC_NONE {
+		panic(fmt.Sprintf("codec id %d is taken", id))
+	}
+	if _, ok := codecs.byName[name]; ok || name == "" {
+		panic(fmt.Sprintf("codec name %q is taken", name))
+	}
+	codecs.byID[id] = codec
+	codecs.byName[name] = id
+}
+
+func init() {
+	RegisterCodec(CODEC_FLATE, "flate", flateCodec{})
+}
+
+// the id of a codec name, "" means no compression
+func codecLookup(name string) (byte, error) {
+	if name == "" {
+		return CODEC_NONE, nil
+	}
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	id, ok := codecs.byName[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown codec %q", name)
+	}
+	return id, nil
+}
+
+// compressed value structure, flagged with BNODE_VAL_COMPRESSED in vlen
+// | codec | size | compressed data |
+// |  1B   |  2B  |       ...       |
+// A value that doesn't shrink is stored as it is.
+func valueEncode(id byte, val []byte) ([]byte, uint16, error) {
+	if id == CODEC_NONE || len(val) < COMPRESS_MIN_SIZE {
+		return val, 0, nil
+	}
+	codecs.mu.RLock()
+	codec := codecs.byID[id]
+	codecs.mu.RUnlock()
+
+	data, err := codec.Compress(val)
+	if err != nil {
+		return nil, 0, fmt.Errorf("compress: %w", err)
+	}
+	if 3 + len(data) >= len(val) {
+		return val, 0, nil
+	}
+	stored := make([]byte, 3, 3 + len(data))
+	stored[0] = id
+	binary.LittleEndian.PutUint16(stored[1:], uint16(len(val)))
+	return append(stored, data...), BNODE_VAL_COMPRESSED, nil
+}
+
+func valueDecode(stored []byte) ([]byte, error) {
+	if len(stored) < 3 {
+		return nil, fmt.Errorf("truncated compressed value")
+	}
+	codecs.mu.RLock()
+	codec, ok := codecs.byID[stored[0]]
+	codecs.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("value compressed with unknown codec %d", stored[0])
+	}
+	size := int(binary.LittleEndian.Uint16(stored[1:]))
+	val, err := codec.Decompress(stored[3:], size)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	if len(val) != size {
+		return nil, fmt.Errorf("decompressed %d bytes instead of %d", len(val), size)
+	}
+	return val, nil
+}
+
+// the value as it was set from the way it is stored
+func valueLogical(stored []byte, vflags uint16) ([]byte, error) {
+	stored, vflags = valueUnexpire(stored, vflags)
+	if vflags & BNODE_VAL_COMPRESSED == 0 {
+		return stored, nil
+	}
+	val, err := valueDecode(stored)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return val, nil
+}
+
+// the size of a value before compression
+func valueSize(stored []byte, vflags uint16) int {
+	stored, vflags = valueUnexpire(stored, vflags)
+	if vflags & BNODE_VAL_COMPRESSED == 0 {
+		return len(stored)
+	}
+	return int(binary.LittleEndian.Uint16(stored[1:]))
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte, size int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	val := make([]byte, size)
+	if _, err := io.ReadFull(r, val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
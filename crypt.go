@@ -0,0 +1,190 @@
+package pandora_db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const KEY_CHECK_OFFSET = 2 * MASTER_SLOT // in the master page
+const KEY_CHECK_SIZE = 8
+
+var ErrEncrypted = errors.New("database is encrypted, a key is required")
+var ErrNotEncrypted = errors.New("database is not encrypted")
+var ErrBadKey = errors.New("wrong encryption key")
+
+// pageCipher encrypts pages and WAL records with AES-GCM
+type pageCipher struct {
+	aead cipher.AEAD
+	check [KEY_CHECK_SIZE]byte // the key check value
+}
+
+func newPageCipher(key []byte) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pageCipher{aead: aead}
+	// the first bytes of the encrypted zero block tell a wrong key
+	var zero [aes.BlockSize]byte
+	block.Encrypt(zero[:], zero[:])
+	copy(pc.check[:], zero[:])
+	return pc, nil
+}
+
+// seal `data` with a fresh nonce appended to the result
+func cryptSeal(pc *pageCipher, dst []byte, data []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, pc.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	dst = pc.aead.Seal(dst, nonce, data, ad)
+	return append(dst, nonce...), nil
+}
+
+func cryptOpen(pc *pageCipher, sealed []byte, ad []byte) ([]byte, error) {
+	size := pc.aead.NonceSize()
+	if len(sealed) < size + pc.aead.Overhead() {
+		return nil, errors.New("truncated ciphertext")
+	}
+	body, nonce := sealed[:len(sealed) - size], sealed[len(sealed) - size:]
+	return pc.aead.Open(nil, nonce, body, ad)
+}
+
+// cryptFile encrypts every page but the master page, which has to be
+// read before the key is checked. An encrypted page:
+// | ciphertext | tag | nonce |
+// |  NODE_SIZE | 16B |  12B  |
+// The page number is authenticated, so pages can't be swapped. A page
+// of zeros was never written or was punched out, it reads as zeros.
+type cryptFile struct {
+	File
+	cipher *pageCipher
+}
+
+func cryptPageAD(ptr uint64) []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	return ad[:]
+}
+
+func (fp *cryptFile) ReadAt(data []byte, offset int64) (int, error) {
+	if offset < BTREE_PAGE_SIZE {
+		assert(offset + int64(len(data)) <= BTREE_PAGE_SIZE)
+		return fp.File.ReadAt(data, offset)
+	}
+	assert(offset % BTREE_PAGE_SIZE == 0 && len(data) % BTREE_PAGE_SIZE == 0)
+
+	n, err := fp.File.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for i := 0; i + BTREE_PAGE_SIZE <= n; i += BTREE_PAGE_SIZE {
+		page := data[i : i + BTREE_PAGE_SIZE]
+		if bytes.Equal(page, make([]byte, BTREE_PAGE_SIZE)) {
+			continue
+		}
+		ptr := uint64(offset) / BTREE_PAGE_SIZE + uint64(i / BTREE_PAGE_SIZE)
+		plain, err := cryptOpen(fp.cipher, page, cryptPageAD(ptr))
+		if err != nil {
+			return i, fmt.Errorf("decrypt page %d: %w", ptr, err)
+		}
+		copy(page, plain)
+		clear(page[len(plain):])
+	}
+	return n, err
+}
+
+func (fp *cryptFile) WriteAt(data []byte, offset int64) (int, error) {
+	if offset < BTREE_PAGE_SIZE {
+		assert(offset + int64(len(data)) <= BTREE_PAGE_SIZE)
+		return fp.File.WriteAt(data, offset)
+	}
+	assert(offset % BTREE_PAGE_SIZE == 0)
+
+	sealed := make([]byte, 0, (len(data) + BTREE_PAGE_SIZE - 1) / BTREE_PAGE_SIZE * BTREE_PAGE_SIZE)
+	for i := 0; i < len(data); i += BTREE_PAGE_SIZE {
+		plain := make([]byte, BTREE_PAGE_SIZE)
+		copy(plain, data[i:])
+		ptr := uint64(offset) / BTREE_PAGE_SIZE + uint64(i / BTREE_PAGE_SIZE)
+		if !bytes.Equal(plain[BTREE_NODE_SIZE:], make([]byte, PAGE_TRAILER)) {
+			return 0, fmt.Errorf("page %d has no room for the encryption trailer", ptr)
+		}
+		var err error
+		sealed, err = cryptSeal(fp.cipher, sealed, plain[:BTREE_NODE_SIZE], cryptPageAD(ptr))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := fp.File.WriteAt(sealed, offset)
+	if n > len(data) {
+		n = len(data)
+	}
+	return n, err
+}
+
+// check the key against the master page and take the file over
+func cryptInit(db *KV) error {
+	var master [KEY_CHECK_OFFSET + KEY_CHECK_SIZE]byte
+	if db.fileSize > 0 {
+		if _, err := db.fp.ReadAt(master[:], 0); err != nil {
+			return fmt.Errorf("read master page: %w", err)
+		}
+	}
+	check := master[KEY_CHECK_OFFSET:]
+	encrypted := !bytes.Equal(check, make([]byte, KEY_CHECK_SIZE))
+	empty := bytes.Equal(master[:MASTER_SLOT + MASTER_SIZE], make([]byte, MASTER_SLOT + MASTER_SIZE))
+
+	if db.opts.EncryptionKey == nil {
+		if encrypted {
+			return ErrEncrypted
+		}
+		return nil
+	}
+	pc, err := newPageCipher(db.opts.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	if encrypted && !bytes.Equal(check, pc.check[:]) {
+		// a crash while creating the database may tear the check value
+		n := 0
+		for n < KEY_CHECK_SIZE && check[n] == pc.check[n] {
+			n++
+		}
+		if !empty || !bytes.Equal(check[n:], make([]byte, KEY_CHECK_SIZE - n)) {
+			return ErrBadKey
+		}
+		encrypted = false
+	}
+	if !encrypted {
+		if !empty {
+			return ErrNotEncrypted
+		}
+		// a new database, the check value goes to the disk before the
+		// WAL can have records encrypted with the key
+		if !db.opts.ReadOnly {
+			if err := extendFile(db, 1); err != nil {
+				return err
+			}
+			if _, err := db.fp.WriteAt(pc.check[:], KEY_CHECK_OFFSET); err != nil {
+				return fmt.Errorf("write key check: %w", err)
+			}
+			if err := db.fp.Sync(); err != nil {
+				return fmt.Errorf("fsync: %w", err)
+			}
+		}
+	}
+
+	db.crypt = pc
+	db.fp = &cryptFile{File: db.fp, cipher: pc}
+	return nil
+}
@@ -3,10 +3,18 @@ package pandora_db
 const HEADER = 4
 
 const BTREE_PAGE_SIZE = 4096
+// the end of every page is kept for the nonce and tag of an encrypted
+// database, see `cryptFile`
+const PAGE_TRAILER = 12 + 16
+// the most a tree node or a free list node may use of its page, older
+// files may have nodes up to the whole page
+const BTREE_NODE_SIZE = BTREE_PAGE_SIZE - PAGE_TRAILER
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
+// a value with a TTL is stored after its expiry time
+const VALUE_TTL_SIZE = 8
 
 func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE;
-	assert(node1max < BTREE_PAGE_SIZE)
+	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE + VALUE_TTL_SIZE;
+	assert(node1max < BTREE_NODE_SIZE)
 }
\ No newline at end of file
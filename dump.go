@@ -0,0 +1,229 @@
+package pandora_db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const DUMP_FORMAT = "pandora-dump"
+const DUMP_VERSION = 1
+// records loaded by one transaction of `KV.Load`
+const LOAD_BATCH = 1000
+
+// Dump format, JSON Lines with the binary data in base64
+//	{"format":"pandora-dump","version":1}
+//	{"key":"...","value":"..."}
+//	{"key":"...","value":"...","expires":1700000000000000000}
+//	{"bucket":"..."}
+//	{"bucket":"...","key":"...","value":"..."}
+// The keys outside buckets come first, then every bucket followed by
+// its keys, all in key order. `expires` is in unix nanoseconds. The
+// values are as they were set, whatever the compression.
+type dumpHeader struct {
+	Format string `json:"format"`
+	Version int `json:"version"`
+}
+
+type dumpRecord struct {
+	Bucket []byte `json:"bucket,omitempty"`
+	Key []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Dump writes every key of the last commit to `w` in a format that
+// doesn't depend on the file, see `dumpRecord`. Like `Backup` it
+// doesn't stop the writers. Expired keys are left out.
+func (db *KV) Dump(w io.Writer) error {
+	if err := dump(db, w); err != nil {
+		return fmt.Errorf("KV.Dump: %w", err)
+	}
+	return nil
+}
+
+func dump(db *KV, w io.Writer) error {
+	snap := &snapshot{db: db}
+	unpin, err := snapshotPin(snap)
+	if err != nil {
+		return err
+	}
+	defer unpin()
+
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(dumpHeader{DUMP_FORMAT, DUMP_VERSION}); err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	if err := dumpTree(snap, enc, nil, snap.root, now); err != nil {
+		return err
+	}
+
+	// the catalog first, the pages of the meta tree are copies
+	names, roots := [][]byte{}, []uint64{}
+	meta := BTree{root: snap.meta, get: snap.page}
+	meta.Scan(bucketKey(""), func(key []byte, val []byte) bool {
+		if key[0] != META_BUCKET {
+			return false
+		}
+		names = append(names, key[1:])
+		roots = append(roots, binary.LittleEndian.Uint64(val))
+		return true
+	})
+	for i, name := range names {
+		if err := enc.Encode(dumpRecord{Bucket: name}); err != nil {
+			return err
+		}
+		if err := dumpTree(snap, enc, name, roots[i], now); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+func dumpTree(snap *snapshot, enc *json.Encoder, bucket []byte, root uint64, now int64) error {
+	if root == 0 {
+		return nil
+	}
+	var err error
+	tree := BTree{root: root, get: snap.page}
+	treeScan(&tree, tree.get(root), nil, func(node BNode, index uint16) bool {
+		stored, vflags := node.getStored(index)
+		if valueExpired(stored, vflags, now) {
+			return true
+		}
+		var val []byte
+		if val, err = valueLogical(stored, vflags); err != nil {
+			return false
+		}
+		err = enc.Encode(dumpRecord{
+			Bucket: bucket,
+			Key: node.getKey(index),
+			Value: val,
+			Expires: valueExpiry(stored, vflags),
+		})
+		return err == nil
+	})
+	return err
+}
+
+// Load sets the keys of a dump made by `Dump`, creating the buckets
+// that are missing. Every LOAD_BATCH records are a transaction. A bad
+// record stops the load, the records before it are set. Keys that
+// expired since the dump are skipped.
+func (db *KV) Load(r io.Reader) error {
+	if err := load(db, r); err != nil {
+		return fmt.Errorf("KV.Load: %w", err)
+	}
+	return nil
+}
+
+func load(db *KV, r io.Reader) error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	// a line holds one record, its key and value in base64
+	in := bufio.NewScanner(r)
+	in.Buffer(nil, 2 * (BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE) + 4096)
+	header := dumpHeader{}
+	if !in.Scan() {
+		if err := in.Err(); err != nil {
+			return fmt.Errorf("header: %w", err)
+		}
+		return fmt.Errorf("header: %w", io.ErrUnexpectedEOF)
+	}
+	if err := json.Unmarshal(in.Bytes(), &header); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	if header.Format != DUMP_FORMAT {
+		return errors.New("not a dump")
+	}
+	if header.Version < 1 || header.Version > DUMP_VERSION {
+		return fmt.Errorf("dump version %d is not supported", header.Version)
+	}
+
+	line := 1
+	for {
+		// the records up to a bad one are loaded before it is reported
+		first, last, batch := line + 1, line, []dumpRecord{}
+		var bad error
+		for len(batch) < LOAD_BATCH && in.Scan() {
+			line++
+			if len(bytes.TrimSpace(in.Bytes())) == 0 {
+				continue
+			}
+			rec := dumpRecord{}
+			err := json.Unmarshal(in.Bytes(), &rec)
+			if err == nil {
+				err = loadCheck(rec)
+			}
+			if err != nil {
+				bad = fmt.Errorf("line %d: %w", line, err)
+				break
+			}
+			batch = append(batch, rec)
+			last = line
+		}
+		if bad == nil && len(batch) < LOAD_BATCH {
+			if err := in.Err(); err != nil {
+				bad = fmt.Errorf("line %d: %w", line + 1, err)
+			}
+		}
+		if len(batch) > 0 {
+			if err := loadBatch(db, batch); err != nil {
+				return fmt.Errorf("lines %d to %d: %w", first, last, err)
+			}
+		}
+		if bad != nil || len(batch) < LOAD_BATCH {
+			return bad
+		}
+	}
+}
+
+// set the records of one transaction
+func loadBatch(db *KV, batch []dumpRecord) error {
+	now := time.Now().UnixNano()
+	return db.Update(func(tx *Tx) error {
+		for _, rec := range batch {
+			if rec.Expires != 0 && rec.Expires <= now {
+				continue
+			}
+			if len(rec.Key) == 0 {
+				if !tx.exists(string(rec.Bucket)) {
+					if err := tx.CreateBucket(string(rec.Bucket)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			err := tx.set(string(rec.Bucket), rec.Key, rec.Value, rec.Expires)
+			if err != nil {
+				return fmt.Errorf("%q: %w", rec.Bucket, err)
+			}
+		}
+		return nil
+	})
+}
+
+// the limits the API asserts
+func loadCheck(rec dumpRecord) error {
+	if len(rec.Key) == 0 {
+		if rec.Value != nil || rec.Expires != 0 {
+			return errors.New("record without a key")
+		}
+		return bucketCheckName(string(rec.Bucket))
+	}
+	if len(rec.Key) > BTREE_MAX_KEY_SIZE || len(rec.Value) > BTREE_MAX_VAL_SIZE {
+		return errors.New("key or value too long")
+	}
+	if rec.Expires != 0 && (rec.Bucket != nil || len(rec.Key) > TTL_MAX_KEY_SIZE) {
+		return errors.New("only keys outside buckets up to TTL_MAX_KEY_SIZE expire")
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+//go:build faults
+
+package pandora_db
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var ErrCrashed = errors.New("simulated crash")
+
+// Faults opens files that misbehave on purpose, for crash tests. The
+// writes go through to the real file, so the mmap sees them, and the
+// files also keep the content that a sync made durable. After `Crash`
+// the files on disk are what a power loss could have left behind.
+// Only built with the `faults` tag, for the programs in test/.
+type Faults struct {
+	FailAt int // the call with this number fails with ENOSPC, 0 for never
+	CrashAt int // every call from this one on fails with ErrCrashed, 0 for never
+
+	mu sync.Mutex
+	calls int
+	crashed bool
+	files []*FaultFile
+}
+
+// a change not synced yet
+type faultOp struct {
+	offset int64
+	data []byte // written bytes, nil for a size change
+	size int64
+	extend bool // the write made the file bigger
+}
+
+type FaultFile struct {
+	File
+	faults *Faults
+	name string
+	durable []byte // the content after the last sync
+	pending []faultOp
+}
+
+// OpenFile is an `OpenFileFunc`, the existing content counts as synced.
+func (fs *Faults) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fp, err := OpenOSFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fp.Size()
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	durable := make([]byte, size)
+	if _, err := fp.ReadAt(durable, 0); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+
+	file := &FaultFile{File: fp, faults: fs, name: name, durable: durable}
+	fs.mu.Lock()
+	fs.files = append(fs.files, file)
+	fs.mu.Unlock()
+	return file, nil
+}
+
+// number of calls that could fail so far
+func (fs *Faults) Calls() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls
+}
+
+func (fs *Faults) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.crashed
+}
+
+// count a call and decide whether it fails
+func faultCall(fs *Faults) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.calls++
+	if fs.crashed || fs.calls == fs.CrashAt {
+		fs.crashed = true
+		return ErrCrashed
+	}
+	if fs.calls == fs.FailAt {
+		return syscall.ENOSPC
+	}
+	return nil
+}
+
+// Crash stops all further calls and rewrites every file opened so far
+// with its synced content plus the unsynced changes picked by `rng`:
+// each of them is kept, dropped or torn at a random byte. A nil `rng`
+// drops them all.
+func (fs *Faults) Crash(rng *rand.Rand) error {
+	fs.mu.Lock()
+	fs.crashed = true
+	files := fs.files
+	fs.files = nil
+	fs.mu.Unlock()
+
+	for _, file := range files {
+		if err := faultRecover(file, rng); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func faultRecover(file *FaultFile, rng *rand.Rand) error {
+	data := file.durable
+	if rng != nil {
+		for _, op := range file.pending {
+			if rng.Intn(3) == 0 {
+				continue // dropped
+			}
+			if op.data == nil {
+				data = faultResize(data, op.size)
+				continue
+			}
+			written := op.data
+			if rng.Intn(3) == 0 {
+				written = written[:rng.Intn(len(written) + 1)] // torn
+			}
+			// a write inside the file is lost past the end of the file
+			// if the change of size that made room for it was dropped
+			if end := int64(len(data)); !op.extend && op.offset + int64(len(written)) > end {
+				if op.offset >= end {
+					continue
+				}
+				written = written[:end - op.offset]
+			}
+			data = faultWrite(data, op.offset, written)
+		}
+	}
+
+	fp, err := os.OpenFile(file.name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fp.Truncate(int64(len(data))); err != nil {
+		return err
+	}
+	_, err = fp.WriteAt(data, 0)
+	return err
+}
+
+func faultResize(data []byte, size int64) []byte {
+	if int64(len(data)) >= size {
+		return data[:size]
+	}
+	return append(data, make([]byte, size - int64(len(data)))...)
+}
+
+func faultWrite(data []byte, offset int64, written []byte) []byte {
+	if end := offset + int64(len(written)); end > int64(len(data)) {
+		data = faultResize(data, end)
+	}
+	copy(data[offset:], written)
+	return data
+}
+
+func (file *FaultFile) WriteAt(data []byte, offset int64) (int, error) {
+	if err := faultCall(file.faults); err != nil {
+		return 0, err
+	}
+	size, err := file.File.Size()
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.File.WriteAt(data, offset)
+	file.pending = append(file.pending, faultOp{
+		offset: offset, data: append([]byte{}, data[:n]...),
+		extend: offset + int64(n) > size,
+	})
+	return n, err
+}
+
+func (file *FaultFile) Sync() error {
+	if err := faultCall(file.faults); err != nil {
+		return err
+	}
+	if err := file.File.Sync(); err != nil {
+		return err
+	}
+	for _, op := range file.pending {
+		if op.data == nil {
+			file.durable = faultResize(file.durable, op.size)
+		} else {
+			file.durable = faultWrite(file.durable, op.offset, op.data)
+		}
+	}
+	file.pending = nil
+	return nil
+}
+
+func (file *FaultFile) Datasync() error {
+	return file.Sync()
+}
+
+func (file *FaultFile) Allocate(mode uint32, offset int64, size int64) error {
+	if err := faultCall(file.faults); err != nil {
+		return err
+	}
+	if err := file.File.Allocate(mode, offset, size); err != nil {
+		return err
+	}
+	if mode & FALLOC_FL_PUNCH_HOLE != 0 {
+		file.pending = append(file.pending, faultOp{
+			offset: offset, data: make([]byte, size),
+		})
+	} else if mode & FALLOC_FL_KEEP_SIZE == 0 {
+		total, err := file.File.Size()
+		if err != nil {
+			return err
+		}
+		file.pending = append(file.pending, faultOp{size: total})
+	}
+	return nil
+}
+
+func (file *FaultFile) Truncate(size int64) error {
+	if err := faultCall(file.faults); err != nil {
+		return err
+	}
+	if err := file.File.Truncate(size); err != nil {
+		return err
+	}
+	file.pending = append(file.pending, faultOp{size: size})
+	return nil
+}
@@ -0,0 +1,122 @@
+package pandora_db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// File is what the database needs from the data and WAL files. With
+// `PagerMmap` pages are read through a shared mmap of `Fd`, so
+// everything written with `WriteAt` must show up in the mapping.
+type File interface {
+	ReadAt(data []byte, offset int64) (int, error)
+	WriteAt(data []byte, offset int64) (int, error)
+	Sync() error
+	Datasync() error
+	Allocate(mode uint32, offset int64, size int64) error
+	Truncate(size int64) error
+	Size() (int64, error)
+	Fd() uintptr
+	Close() error
+}
+
+// opens a `File`, see `OpenOptions.OpenFile`
+type OpenFileFunc func(name string, flag int, perm os.FileMode) (File, error)
+
+type osFile struct {
+	*os.File
+}
+
+// OpenOSFile opens a plain file, the default for `OpenOptions.OpenFile`.
+func OpenOSFile(name string, flag int, perm os.FileMode) (File, error) {
+	fp, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{fp}, nil
+}
+
+func (fp osFile) Datasync() error {
+	return syscall.Fdatasync(int(fp.Fd()))
+}
+
+func (fp osFile) Allocate(mode uint32, offset int64, size int64) error {
+	return syscall.Fallocate(int(fp.Fd()), mode, offset, size)
+}
+
+func (fp osFile) Size() (int64, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return fi.Size(), nil
+}
+
+// fsync the directory of `path`, so that a file renamed into it stays
+// there after a crash
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("fsync directory: %w", err)
+	}
+	return nil
+}
+
+// memFile is the file of an in-memory database. The pages are kept by
+// the `fullCachePager`, the file only tracks its size and syncs nothing.
+type memFile struct {
+	size int64
+}
+
+func (fp *memFile) ReadAt(data []byte, offset int64) (int, error) {
+	return 0, io.EOF
+}
+
+func (fp *memFile) WriteAt(data []byte, offset int64) (int, error) {
+	if end := offset + int64(len(data)); end > fp.size {
+		fp.size = end
+	}
+	return len(data), nil
+}
+
+func (fp *memFile) Sync() error {
+	return nil
+}
+
+func (fp *memFile) Datasync() error {
+	return nil
+}
+
+func (fp *memFile) Allocate(mode uint32, offset int64, size int64) error {
+	if end := offset + size; mode & FALLOC_FL_KEEP_SIZE == 0 && end > fp.size {
+		fp.size = end
+	}
+	return nil
+}
+
+func (fp *memFile) Truncate(size int64) error {
+	fp.size = size
+	return nil
+}
+
+func (fp *memFile) Size() (int64, error) {
+	return fp.size, nil
+}
+
+func (fp *memFile) Fd() uintptr {
+	return ^uintptr(0)
+}
+
+func (fp *memFile) Close() error {
+	return nil
+}
@@ -4,7 +4,10 @@ import "encoding/binary"
 
 const BNODE_FREE_LIST = 3
 const FREE_LIST_HEADER = 4 + 8 + 8
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+const FREE_LIST_CAP = (BTREE_NODE_SIZE - FREE_LIST_HEADER) / 8
+
+// marks pointers to pages whose disk space was given back to the OS
+const FREE_LIST_PUNCHED = uint64(1) << 63
 
 // FreeList node structure
 // | type | size | total | next |  pointers |
@@ -15,6 +18,7 @@ type FreeList struct {
 	get func(uint64) BNode
 	new func(BNode) uint64
 	use func(uint64, BNode)
+	hold func(uint64) bool // keep a page dropped from the list out of it
 }
 
 func flnSize(node BNode) int {
@@ -56,6 +60,47 @@ func (fl *FreeList) Total() int {
 
 	return int(binary.LittleEndian.Uint64(node.data[4:]))
 }
+// all pointers in the list and the pages holding the list itself
+func (fl *FreeList) List() ([]uint64, []uint64) {
+	ptrs, nodes := []uint64{}, []uint64{}
+	for next := fl.head; next != 0; {
+		node := fl.get(next)
+		nodes = append(nodes, next)
+		for i := 0; i < flnSize(node); i++ {
+			ptrs = append(ptrs, flnPtr(node, i))
+		}
+		next = flnNext(node)
+	}
+	return ptrs, nodes
+}
+
+// replace the whole list with `ptrs`, stored in the given `nodes` pages
+func (fl *FreeList) Reset(ptrs []uint64, nodes []uint64) {
+	assert(len(ptrs) <= len(nodes) * FREE_LIST_CAP)
+	total := len(ptrs)
+	fl.head = 0
+	for _, ptr := range nodes {
+		node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+
+		size := len(ptrs)
+		if size > FREE_LIST_CAP {
+			size = FREE_LIST_CAP
+		}
+		flnSetHeader(node, uint16(size), fl.head)
+		for i := 0; i < size; i++ {
+			flnSetPtr(node, i, ptrs[i])
+		}
+		ptrs = ptrs[size:]
+
+		fl.use(ptr, node)
+		fl.head = ptr &^ FREE_LIST_PUNCHED
+	}
+
+	if fl.head != 0 {
+		flnSetTotal(fl.get(fl.head), uint64(total))
+	}
+}
+
 // get the nth pointer
 func (fl *FreeList) Get(topn int) uint64 {
 	assert(0 <= topn && topn < fl.Total())
@@ -77,9 +122,17 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 
 	total := fl.Total()
 	reuse := []uint64{}
-	for fl.head != 0 && len(reuse) * FREE_LIST_CAP < len(freed) {
+	held := false
+	// the total is never written to a page of the old list, so keep
+	// going until there is something to push if its pages were held
+	for fl.head != 0 && (popn > 0 || len(reuse) * FREE_LIST_CAP < len(freed) ||
+		(held && len(freed) == 0)) {
 		node := fl.get(fl.head)
-		freed = append(freed, fl.head)
+		if fl.hold != nil && fl.hold(fl.head) {
+			held = true
+		} else {
+			freed = append(freed, fl.head)
+		}
 		if popn >= flnSize(node) {
 				popn -= flnSize(node)
 		} else {
@@ -101,9 +154,17 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 	}
 	assert(len(reuse) * FREE_LIST_CAP >= len(freed) || fl.head == 0)	
 
+	// put back the pages that are not needed for the new nodes
+	for len(reuse) * FREE_LIST_CAP >= len(freed) + FREE_LIST_CAP {
+		freed = append(freed, reuse[len(reuse) - 1])
+		reuse = reuse[:len(reuse) - 1]
+	}
+
 	flPush(fl, freed, reuse)
 
-	flnSetTotal(fl.get(fl.head), uint64(total + len(freed)))
+	if fl.head != 0 {
+		flnSetTotal(fl.get(fl.head), uint64(total + len(freed)))
+	}
 }
 
 func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
@@ -123,8 +184,8 @@ func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
 		freed = freed[size:]
 
 		if len(reuse) > 0 {
-			fl.head, reuse = reuse[0], reuse[1:]
-			fl.use(fl.head, node)
+			fl.use(reuse[0], node)
+			fl.head, reuse = reuse[0] &^ FREE_LIST_PUNCHED, reuse[1:]
 		} else {
 			fl.head = fl.new(node)
 		}
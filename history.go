@@ -0,0 +1,106 @@
+package pandora_db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+const HISTORY_ID_SIZE = 16
+// entries kept, a follower whose entry was trimmed is refused
+const HISTORY_MAX_ENTRIES = 64
+
+// history entry in the meta tree, one per writer that committed to a
+// replicated file
+// | 'h' | start | -> | id  |
+// | 1B  |  8B   |    | 16B |
+// `start` is the version the writer opened the file at and `id` is
+// random. The commits after `start` up to the next entry are those of
+// the writer. A copy of the file written on gets an entry of its own,
+// so a follower tells the primary the id of its last entry, and the
+// primary checks that its last commit is one of its own, see
+// `historyCheck`. Only a file that serves replicas, or a copy of one,
+// gets entries, and the oldest past HISTORY_MAX_ENTRIES are deleted.
+func historyKey(start uint64) []byte {
+	var be [8]byte
+	binary.BigEndian.PutUint64(be[:], start)
+	return metaKey(META_HISTORY, be[:])
+}
+
+// add the entry of this writer to the commit being flushed, unless the
+// file has it already or is not replicated. `rollback` takes it back
+// with the commit.
+func historyBegin(db *KV) {
+	if db.history.on || !db.history.want {
+		return
+	}
+	if db.history.id == nil {
+		db.history.id = make([]byte, HISTORY_ID_SIZE)
+		_, err := rand.Read(db.history.id)
+		assert(err == nil)
+	}
+	old := [][]byte{}
+	db.meta.Scan(historyKey(0), func(key []byte, _ []byte) bool {
+		if key[0] != META_HISTORY {
+			return false
+		}
+		old = append(old, append([]byte{}, key...))
+		return true
+	})
+	for len(old) >= HISTORY_MAX_ENTRIES {
+		db.meta.Delete(old[0])
+		old = old[1:]
+	}
+	db.meta.Insert(historyKey(db.history.start), db.history.id)
+	db.history.on = true
+}
+
+// true if the file has an entry
+func historyAny(db *KV) bool {
+	found := false
+	db.meta.Scan(historyKey(0), func(key []byte, _ []byte) bool {
+		found = key[0] == META_HISTORY
+		return false
+	})
+	return found
+}
+
+// the id of the last entry, zeros for a file without one
+func historyLast(meta *BTree) []byte {
+	id := make([]byte, HISTORY_ID_SIZE)
+	meta.Scan(historyKey(0), func(key []byte, val []byte) bool {
+		if key[0] != META_HISTORY {
+			return false
+		}
+		copy(id, val)
+		return true
+	})
+	return id
+}
+
+// whether commit `version` of a follower whose last entry is `id` is
+// in the history of `meta`. A file without entries only has commits
+// older than the first one.
+func historyCheck(meta *BTree, version uint64, id []byte) error {
+	if version == 0 {
+		return nil // a new follower
+	}
+	found := bytes.Equal(id, make([]byte, HISTORY_ID_SIZE))
+	end := ^uint64(0)
+	meta.Scan(historyKey(0), func(key []byte, val []byte) bool {
+		if key[0] != META_HISTORY {
+			return false
+		}
+		if found {
+			end = binary.BigEndian.Uint64(key[1:])
+			return false
+		}
+		found = bytes.Equal(val, id)
+		return true
+	})
+	if !found || version > end {
+		return errors.New("the follower has commits the primary doesn't have")
+	}
+	return nil
+}
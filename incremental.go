@@ -0,0 +1,293 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// An unencrypted page has the version of the commit that wrote it in
+// its trailer, zero for the pages written before. Copy-on-write
+// rewrites the parents of a written page, so a page no newer than some
+// commit has no newer children.
+const PAGE_STAMP_OFFSET = BTREE_NODE_SIZE
+
+const BACKUP_SIG = "PANDORA_BACKUP1\x00"
+const BACKUP_HEADER = 16 + 8 + 8 + 8
+
+var ErrBackupChain = errors.New("backup doesn't follow the previous one")
+
+// the node ends before the trailer, older files may have bigger ones.
+// A free page may hold anything.
+func pageFits(page []byte) bool {
+	node := BNode{page}
+	switch node.btype() {
+	case BNODE_NODE, BNODE_LEAF:
+		if HEADER + int(node.nkeys()) * 10 > BTREE_NODE_SIZE {
+			return false
+		}
+		return node.nbytes() <= BTREE_NODE_SIZE
+	default:
+		return FREE_LIST_HEADER + 8 * flnSize(node) <= BTREE_NODE_SIZE
+	}
+}
+
+// mark a page written by commit `version`
+func pageStampSet(page []byte, version uint64) {
+	if len(page) == BTREE_PAGE_SIZE && pageFits(page) {
+		binary.LittleEndian.PutUint64(page[PAGE_STAMP_OFFSET:], version)
+	}
+}
+
+// the commit that wrote a page, zero if unknown
+func pageStamp(page []byte) uint64 {
+	if !pageFits(page) {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(page[PAGE_STAMP_OFFSET:])
+}
+
+// a page without its stamp, the trailer of an encrypted page is taken
+func pageUnstamped(page []byte) []byte {
+	if pageStamp(page) == 0 {
+		return page
+	}
+	page = append([]byte{}, page...)
+	clear(page[PAGE_STAMP_OFFSET:][:8])
+	return page
+}
+
+// BackupSince writes the pages changed by the commits after `since`
+// to `w`, with a master page for the last one, and returns its version.
+// Pass it as `since` of the next backup. With `since` 0 every page is
+// written, which makes a full backup the others go on from, see
+// `Restore`. Like `Backup` it doesn't stop the writers. The pages of an
+// encrypted database have no room for the version.
+//
+// Backup stream
+// | sig | since | version | npages | pages: | ptr | page | |
+// | 16B |   8B  |    8B   |   8B   |        |  8B |  4KB | |
+// The master page comes last, as page 0. The free list is made up from
+// the pages outside the trees.
+func (db *KV) BackupSince(since uint64, w io.Writer) (uint64, error) {
+	version, err := backupSince(db, since, w)
+	if err != nil {
+		return 0, fmt.Errorf("KV.BackupSince: %w", err)
+	}
+	return version, nil
+}
+
+func backupSince(db *KV, since uint64, w io.Writer) (uint64, error) {
+	if db.crypt != nil {
+		return 0, errors.New("incremental backups of an encrypted database are not supported")
+	}
+	snap := &snapshot{db: db, w: w}
+	unpin, err := snapshotPin(snap)
+	if err != nil {
+		return 0, err
+	}
+	defer unpin()
+
+	header := backupHeaderPack(backupHeader{since, snap.version, snap.npages})
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+
+	live := make([]bool, snap.npages)
+	err = snap.changed(snap.root, snap.height(snap.root), false, since, true, live)
+	if err == nil {
+		err = snap.changed(snap.meta, snap.height(snap.meta), true, since, true, live)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// every other page is free in the copy
+	ptrs := []uint64{}
+	for ptr := uint64(1); ptr < snap.npages; ptr++ {
+		if !live[ptr] {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	k := 0
+	for k * FREE_LIST_CAP < len(ptrs) - k {
+		k++
+	}
+	nodes := map[uint64]BNode{}
+	free := FreeList{
+		get: func(ptr uint64) BNode { return nodes[ptr] },
+		use: func(ptr uint64, node BNode) { nodes[ptr] = node },
+	}
+	free.Reset(ptrs[k:], ptrs[:k])
+	for ptr, node := range nodes {
+		if err := snap.emit(ptr, node.data); err != nil {
+			return 0, err
+		}
+	}
+
+	master := make([]byte, BTREE_PAGE_SIZE)
+	data := masterPack([]uint64{snap.root, snap.npages, free.head, snap.version, 0, snap.meta})
+	copy(master, data[:])
+	if err := snap.emit(0, master); err != nil {
+		return 0, err
+	}
+	return snap.version, nil
+}
+
+// write the pages of the tree at `ptr` that are newer than `since`
+// and mark all of them `live`. The leaves below an older page are not
+// read, unless they hold the roots of the buckets.
+func (snap *snapshot) changed(ptr uint64, height int, meta bool, since uint64, dirty bool, live []bool) error {
+	if ptr == 0 {
+		return nil
+	}
+	live[ptr] = true
+	if height == 1 && !meta && !dirty {
+		return nil
+	}
+	node := snap.page(ptr)
+	stamp := pageStamp(node.data)
+	dirty = dirty && (stamp == 0 || stamp > since)
+	if dirty {
+		if err := snap.emit(ptr, node.data); err != nil {
+			return err
+		}
+	}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			err := snap.changed(node.getPtr(i), height - 1, meta, since, dirty, live)
+			if err != nil {
+				return err
+			}
+		}
+	} else if meta {
+		for _, i := range catalogRoots(node) {
+			stored, _ := node.getStored(i)
+			root := binary.LittleEndian.Uint64(stored)
+			err := snap.changed(root, snap.height(root), false, since, dirty, live)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (snap *snapshot) emit(ptr uint64, page []byte) error {
+	var head [8]byte
+	binary.LittleEndian.PutUint64(head[:], ptr)
+	if _, err := snap.w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := snap.w.Write(page)
+	return err
+}
+
+// Restore makes a database file at `path` from a full backup and the
+// backups taken after it by `KV.BackupSince`, in order. Each one has
+// to start at or before the version of the previous one. The file is
+// replaced once they all applied.
+func Restore(path string, backups ...io.Reader) error {
+	tmp := path + ".tmp"
+	fp, err := OpenOSFile(tmp, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+	err = restore(fp, backups)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("Restore: %w", err)
+	}
+	if err := syncDir(path); err != nil {
+		return fmt.Errorf("Restore: %w", err)
+	}
+	return nil
+}
+
+func restore(fp File, backups []io.Reader) error {
+	if len(backups) == 0 {
+		return errors.New("no backups")
+	}
+	version := uint64(0)
+	for n, r := range backups {
+		h, err := backupHeaderRead(r)
+		if err != nil {
+			return fmt.Errorf("backup %d: %w", n, err)
+		}
+		if (n == 0 && h.since != 0) || h.since > version || h.version < version {
+			return fmt.Errorf("backup %d: %w", n, ErrBackupChain)
+		}
+		master, err := backupPages(r, h, func(ptr uint64, page []byte) error {
+			_, err := fp.WriteAt(page, int64(ptr * BTREE_PAGE_SIZE))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("backup %d: %w", n, err)
+		}
+		// the master page goes last, over a file of the right size
+		if err := fp.Truncate(int64(h.npages * BTREE_PAGE_SIZE)); err != nil {
+			return err
+		}
+		if _, err := fp.WriteAt(master, 0); err != nil {
+			return err
+		}
+		version = h.version
+	}
+	return fp.Sync()
+}
+
+type backupHeader struct {
+	since, version, npages uint64
+}
+
+func backupHeaderPack(h backupHeader) []byte {
+	header := []byte(BACKUP_SIG)
+	header = binary.LittleEndian.AppendUint64(header, h.since)
+	header = binary.LittleEndian.AppendUint64(header, h.version)
+	return binary.LittleEndian.AppendUint64(header, h.npages)
+}
+
+func backupHeaderRead(r io.Reader) (backupHeader, error) {
+	header := make([]byte, BACKUP_HEADER)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return backupHeader{}, err
+	}
+	if string(header[:len(BACKUP_SIG)]) != BACKUP_SIG {
+		return backupHeader{}, errors.New("bad signature")
+	}
+	return backupHeader{
+		since: binary.LittleEndian.Uint64(header[16:]),
+		version: binary.LittleEndian.Uint64(header[24:]),
+		npages: binary.LittleEndian.Uint64(header[32:]),
+	}, nil
+}
+
+// read the pages after the header, `fn` gets all of them but the
+// master page, which is returned. The page is only valid until `fn`
+// returns.
+func backupPages(r io.Reader, h backupHeader, fn func(ptr uint64, page []byte) error) ([]byte, error) {
+	page := make([]byte, 8 + BTREE_PAGE_SIZE)
+	for {
+		if _, err := io.ReadFull(r, page); err != nil {
+			return nil, err
+		}
+		ptr := binary.LittleEndian.Uint64(page)
+		if ptr >= h.npages {
+			return nil, fmt.Errorf("bad page %d", ptr)
+		}
+		if ptr == 0 {
+			return page[8:], nil
+		}
+		if err := fn(ptr, page[8:]); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -5,29 +5,98 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"net"
 	"os"
-	"syscall"
+	"sync"
+	"sync/atomic"
 )
 
 const DB_SIG = "1616161616161616"
 
+var ErrReadOnly = errors.New("database is opened read-only")
+
+// a follower is only changed by its primary
+func readOnly(db *KV) bool {
+	return db.opts.ReadOnly || db.opts.Primary != ""
+}
+
 type KV struct {
 	Path string
 
-	fp *os.File
+	opts OpenOptions
+	mu sync.RWMutex // readers vs the single writer
+	fp File
 	tree BTree
+	meta BTree // internal data, see `metaKey`
 	free FreeList
+	version uint64 // number of the last commit
+	pending uint64 // head of the pages freed while readers may still see them
+	master int // the copy of the master page with the last commit
+	readers *readerTable // shared with reader processes
+	backups []uint64 // versions being copied by `KV.Backup`
+	synced uint64 // last commit whose master page is in the file
+	fatal error // a failed background sync, WAL replay or follower write, writes fail from then on
+	corrupt atomic.Pointer[error] // a corrupt value found by a read, see `valueCorrupt`
+	crypt *pageCipher // with `OpenOptions.EncryptionKey`
+	codec byte // of `OpenOptions.Compression`
+	ttlIndexed bool // the expiry index may have entries, see `applySet`
+	// the last commit, see `rollback`
+	last struct {
+		root, meta, free, pending, flushed, version uint64
+		held int
+	}
+	syncStop chan struct{}
+	syncDone chan struct{}
+	sweepStop chan struct{}
+	sweepDone chan struct{}
+	followStop chan struct{}
+	followDone chan struct{}
+
+	wal struct {
+		fp File // the "-wal" file in WAL mode
+		size int64
+	}
+	history struct {
+		id []byte // of this writer, see `historyKey`
+		start uint64 // the version the file was opened at
+		on bool // the meta tree has the entry of this writer
+		want bool // the file is replicated, see `historyBegin`
+	}
+	changes struct {
+		version uint64 // of the commit whose changes are being logged
+		next uint64 // number of the next change in the commit
+		on bool // the commit logs its changes
+	}
+	watch struct {
+		mu sync.Mutex // guards the list, the rest belongs to the leader
+		list []*watcher
+		on bool // the batch being committed is watched
+		changes []Change // made by the batch
+	}
+	repl struct {
+		mu sync.Mutex
+		list []*replica // followers being served
+		listeners []net.Listener // of `KV.ServeReplicas`
+		closed bool
+		serving sync.WaitGroup // one per follower
+	}
+	group struct {
+		mu sync.Mutex
+		busy bool // a writer is committing a batch
+		reqs []*commitReq // waiting for the next batch
+	}
 
-	mmap struct {
-		file int // file size
-		total int // mmap size
-		chunks [][]byte // mmap data
-	}	
+	pager Pager
+	fileSize int // data file size in bytes
 	page struct {
 		flushed uint64 // database size in number of pages		
 		nfree int // number of pages taken from free list
 		nappend int // number of pages to append
 		updates map[uint64][]byte // newly allocated or deallocated pages 
+		holes []uint64 // reused pages that were punched out of the file
+		released []uint64 // pending pages that are safe to reuse now
+		held []heldPage // list pages waiting for a sync, see `pageHold`
 	}
 }
 
@@ -37,20 +106,24 @@ func (db *KV) pageGet(ptr uint64) BNode {
 
 		return BNode{page}
 	}
-	return pageGetMapped(db, ptr)
+	return BNode{db.pager.Page(ptr)}
 }
 
-func pageGetMapped(db *KV, ptr uint64) BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk)) / BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset + BTREE_PAGE_SIZE]}
-		}
-		start = end
+// like `pageGet`, a flushed page stays in the cache of the pager until
+// `pageUnpin`. Pages of the commit being built are not pinned, they
+// can't change while a scan holds the lock.
+func (db *KV) pagePin(ptr uint64) BNode {
+	if page, ok := db.page.updates[ptr]; ok {
+		assert(page != nil)
+		return BNode{page}
+	}
+	return BNode{db.pager.Pin(ptr)}
+}
+
+func (db *KV) pageUnpin(ptr uint64) {
+	if _, ok := db.page.updates[ptr]; !ok {
+		db.pager.Unpin(ptr)
 	}
-	panic("invalid ptr")
 }
 
 func (db *KV) pageNew(node BNode) uint64 {
@@ -58,7 +131,7 @@ func (db *KV) pageNew(node BNode) uint64 {
 	ptr := uint64(0)
 
 	if db.page.nfree < db.free.Total() {
-		ptr = db.free.Get(db.page.nfree)
+		ptr = pageReclaim(db, db.free.Get(db.page.nfree))
 		db.page.nfree++
 	} else {
 		ptr = db.page.flushed + uint64(db.page.nappend)
@@ -81,58 +154,161 @@ func (db *KV) pageAppend(node BNode) uint64 {
 }
 
 func (db *KV) pageUse(ptr uint64, node BNode) {
+	ptr = pageReclaim(db, ptr)
 	db.page.updates[ptr] = node.data
 }
 
-// db page structure:
-// sig | root | pages used | free list |
-// 16B |  8B  |     8B		 |     8B    |
+const MASTER_SLOT = 64 // offset of the second copy of the master page
+const MASTER_SIZE = 60
+const DB_SIG2 = "PANDORA2"
+
+// fields of the master page
+const (
+	MASTER_ROOT = iota
+	MASTER_USED
+	MASTER_FREE
+	MASTER_VERSION
+	MASTER_PENDING
+	MASTER_META
+)
+
+// db page structure, two copies at 0 and MASTER_SLOT:
+// sig | root | pages used | free list | version | pending | meta | crc32 |
+// 8B  |  8B  |     8B     |     8B    |   8B    |   8B    |  8B  |  4B   |
+// `meta` is the root of the tree of internal data, see `metaKey`.
+// Files written before it have the 16 byte DB_SIG and no meta root.
+// A commit overwrites the older copy, so a torn write of the master
+// page leaves the previous commit.
+// An encrypted database has a key check value at KEY_CHECK_OFFSET.
+func masterSigSize(data []byte, slot int) int {
+	copy := data[slot * MASTER_SLOT:]
+	switch {
+	case bytes.Equal([]byte(DB_SIG2), copy[:len(DB_SIG2)]):
+		return len(DB_SIG2)
+	case bytes.Equal([]byte(DB_SIG), copy[:len(DB_SIG)]):
+		return len(DB_SIG)
+	}
+	return 0
+}
+
+func masterField(data []byte, slot int, field int) uint64 {
+	sig := masterSigSize(data, slot)
+	if sig == len(DB_SIG) && field == MASTER_META {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data[slot * MASTER_SLOT + sig + 8 * field:])
+}
+
+func masterValid(data []byte, slot int) bool {
+	copy := data[slot * MASTER_SLOT:][:MASTER_SIZE]
+	sig := masterSigSize(data, slot)
+	if sig == 0 {
+		return false
+	}
+	sum := binary.LittleEndian.Uint32(copy[MASTER_SIZE - 4:])
+	// written before there were two copies with a checksum
+	legacy := slot == 0 && sig == len(DB_SIG) && sum == 0 &&
+		bytes.Equal(data[MASTER_SLOT:][:MASTER_SIZE], make([]byte, MASTER_SIZE))
+	return legacy || crc32.ChecksumIEEE(copy[:MASTER_SIZE - 4]) == sum
+}
+
+// the valid copy with the latest commit, -1 if there is none
+func masterPick(data []byte) int {
+	pick := -1
+	for slot := 0; slot < 2; slot++ {
+		if !masterValid(data, slot) {
+			continue
+		}
+		if pick < 0 || masterField(data, slot, MASTER_VERSION) > masterField(data, pick, MASTER_VERSION) {
+			pick = slot
+		}
+	}
+	return pick
+}
+
 func masterLoad(db *KV) error {
-	if db.mmap.file == 0 {
+	db.master = 1 // the first commit goes to the first copy
+	if db.fileSize == 0 {
 		db.page.flushed = 1
 		return nil
 	}
 
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
-	free := binary.LittleEndian.Uint64(data[32:])
-	
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("Bad database signature")
+	data := db.pager.Page(0)
+	slot := masterPick(data)
+	if slot < 0 {
+		// a crash before the first commit leaves the file without a master page
+		if bytes.Equal(data[:MASTER_SLOT + MASTER_SIZE], make([]byte, MASTER_SLOT + MASTER_SIZE)) {
+			db.page.flushed = 1
+			return nil
+		}
+		if masterSigSize(data, 0) == 0 && masterSigSize(data, 1) == 0 {
+			return errors.New("Bad database signature")
+		}
+		return errors.New("Bad master page")
 	}
-	bad := !(1 <= used && used <= uint64(db.mmap.file / BTREE_PAGE_SIZE))
+
+	root := masterField(data, slot, MASTER_ROOT)
+	used := masterField(data, slot, MASTER_USED)
+	free := masterField(data, slot, MASTER_FREE)
+	version := masterField(data, slot, MASTER_VERSION)
+	pending := masterField(data, slot, MASTER_PENDING)
+	meta := masterField(data, slot, MASTER_META)
+
+	bad := !(1 <= used && used <= uint64(db.fileSize / BTREE_PAGE_SIZE))
 	bad = bad || !(0 <= root && root < used)
+	bad = bad || !(free < used && pending < used && meta < used)
 	if bad {
 		return errors.New("Bad master page")
 	}
 	
 	db.tree.root = root	
+	db.meta.root = meta
 	db.page.flushed = used
 	db.free.head = free
+	db.version = version
+	db.pending = pending
+	db.master = slot
 	return nil
 }
 
-func masterStore(db *KV) error {
-	var data [40]byte
-	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[32:], db.free.head)
+func masterData(db *KV) [MASTER_SIZE]byte {
+	return masterPack([]uint64{
+		db.tree.root, db.page.flushed, db.free.head, db.version, db.pending, db.meta.root,
+	})
+}
+
+// a copy of the master page with `fields` in the order of MASTER_ROOT...
+func masterPack(fields []uint64) [MASTER_SIZE]byte {
+	var data [MASTER_SIZE]byte
+	copy(data[:], []byte(DB_SIG2))
+	for i, field := range fields {
+		binary.LittleEndian.PutUint64(data[len(DB_SIG2) + 8 * i:], field)
+	}
+	sum := crc32.ChecksumIEEE(data[:MASTER_SIZE - 4])
+	binary.LittleEndian.PutUint32(data[MASTER_SIZE - 4:], sum)
+	return data
+}
 
-	_, err := db.fp.WriteAt(data[:], 0)
+func masterStore(db *KV) error {
+	data := masterData(db)
+	slot := 1 - db.master
+	err := db.pager.WriteAt(data[:], int64(slot * MASTER_SLOT))
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
 
+	db.master = slot
 	return nil
 }
 
 func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.fileSize / BTREE_PAGE_SIZE
 	if filePages >= npages {
 		return nil
 	}
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
 
 	for filePages < npages {
 		inc := filePages / 8
@@ -143,47 +319,136 @@ func extendFile(db *KV, npages int) error {
 	}
 
 	fileSize := filePages * BTREE_PAGE_SIZE
-	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
+	err := db.fp.Allocate(0, int64(db.fileSize), int64(fileSize - db.fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
 	}
 
-	db.mmap.file = fileSize
+	db.fileSize = fileSize
 	return nil
 }
 
+// open with `DefaultOpenOptions`
 func (db *KV) Open() error {
-	fp, err := os.OpenFile(db.Path, os.O_RDWR | os.O_CREATE, 0644)
+	db.opts = DefaultOpenOptions()
+	return db.open()
+}
+
+func (db *KV) open() error {
+	if err := db.opts.validate(); err != nil {
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.codec, _ = codecLookup(db.opts.Compression)
+
+	flags := os.O_RDWR
+	if db.opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	if db.opts.CreateIfMissing {
+		flags |= os.O_CREATE
+	}
+	if db.opts.ErrorIfExists {
+		flags |= os.O_EXCL
+	}
+	var fp File
+	var err error
+	if db.opts.InMemory {
+		fp = &memFile{}
+	} else {
+		fp, err = db.opts.OpenFile(db.Path, flags, db.opts.FileMode)
+	}
 	if err != nil {
 		return fmt.Errorf("open file: %w", err)
 	}
 
 	db.fp = fp
 
-	sz, chunk, err := mmapInit(db.fp)
+	var size int64
+	err = lockFile(db)
+	if err != nil {
+		goto fail
+	}
+
+	size, err = db.fp.Size()
+	if err != nil {
+		goto fail
+	}
+	if size % BTREE_PAGE_SIZE != 0 {
+		err = fmt.Errorf("File size is not multiple of page size")
+		goto fail
+	}
+	db.fileSize = int(size)
+
+	err = cryptInit(db)
 	if err != nil {
 		goto fail
 	}
 
-	db.mmap.chunks = [][]byte{chunk}
-	db.mmap.file = sz
-	db.mmap.total = len(chunk)	
+	db.pager, err = openPager(db, db.fileSize / BTREE_PAGE_SIZE)
+	if err != nil {
+		goto fail
+	}
 
 	db.tree.get = db.pageGet
 	db.tree.del = db.pageDel
 	db.tree.new = db.pageNew	
+	db.tree.pin = db.pagePin
+	db.tree.unpin = db.pageUnpin
+	db.tree.corrupt = db.valueCorrupt
+	db.meta = BTree{
+		get: db.pageGet, del: db.pageDel, new: db.pageNew,
+		pin: db.pagePin, unpin: db.pageUnpin, corrupt: db.valueCorrupt,
+	}
 
 	db.free.get = db.pageGet
 	db.free.new = db.pageAppend
 	db.free.use = db.pageUse
+	db.free.hold = db.pageHold
 
 	db.page.updates = make(map[uint64][]byte)
 
-	err = masterLoad(db)
-	if err != nil {
-		goto fail
+	// reader processes load the master page on each read, the writer may
+	// not have written it yet
+	if !db.opts.MultiProcess || !db.opts.ReadOnly {
+		err = masterLoad(db)
+		if err != nil {
+			goto fail
+		}
+		if !db.opts.InMemory {
+			err = followRecover(db)
+			if err != nil {
+				goto fail
+			}
+		}
+	}
+
+	db.synced = db.version
+	commitDone(db)
+	db.ttlIndexed = ttlAny(db)
+	db.history.start = db.version
+	db.history.want = historyAny(db)
+
+	if !db.opts.InMemory && (!db.opts.MultiProcess || !db.opts.ReadOnly) {
+		err = openWAL(db)
+		if err != nil {
+			goto fail
+		}
+	}
+
+	if db.opts.MultiProcess {
+		err = openReaders(db)
+		if err != nil {
+			goto fail
+		}
 	}
 
+	if db.opts.SyncMode == SyncPeriodic && !db.opts.ReadOnly {
+		startSyncLoop(db)
+	}
+	ttlStart(db)
+	if db.opts.Primary != "" {
+		startFollowLoop(db)
+	}
 	return nil
 
 fail:
@@ -192,34 +457,171 @@ fail:
 }
 
 func (db *KV) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		assert(err == nil)
+	if db.followStop != nil {
+		stopFollowLoop(db)
+	}
+	replCloseAll(db)
+	if db.sweepStop != nil {
+		stopSweepLoop(db)
+	}
+	if db.syncStop != nil {
+		stopSyncLoop(db)
+		if db.fatal == nil {
+			_ = closeSync(db)
+		}
+	}
+	if db.wal.fp != nil {
+		closeWAL(db)
+	}
+	watchCloseAll(db)
+	if db.readers != nil {
+		closeReaders(db)
+	}
+	if db.pager != nil {
+		_ = db.pager.Close()
+		db.pager = nil
+	}
+	if db.fp != nil {
+		unlockFile(db)
+		_ = db.fp.Close()
 	}
-	_ = db.fp.Close()
 }
 
+// Get returns a copy of the value of `key`, which stays valid after
+// later commits and a compaction.
 func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+	if db.readers != nil && db.opts.ReadOnly {
+		return readerGet(db, key)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	val, ok := db.tree.Get(key)
+	// the page may be reused or truncated once unlocked
+	return append([]byte{}, val...), ok
+}
+
+// Scan calls `fn` with the keys from `start` on in order, until it
+// returns false. The database can't be changed from `fn`. The key and
+// value point into the page and are only valid during the call of
+// `fn`, which has to copy them to keep them.
+func (db *KV) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	if db.readers != nil && db.opts.ReadOnly {
+		readerScan(db, start, fn)
+		return
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.tree.Scan(start, fn)
 }
 
+// set with the codec of `OpenOptions.Compression`
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+	return set(db, key, val, db.codec)
+}
+
+// SetCompressed sets a value compressed with the codec registered as
+// `codec`, "" stores it as it is.
+func (db *KV) SetCompressed(key []byte, val []byte, codec string) error {
+	id, err := codecLookup(codec)
+	if err != nil {
+		return fmt.Errorf("KV.SetCompressed: %w", err)
+	}
+	return set(db, key, val, id)
+}
+
+func set(db *KV, key []byte, val []byte, codec byte) error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	// checked here so that a bad key fails its own caller
+	assert(len(key) != 0)
+	assert(len(key) <= BTREE_MAX_KEY_SIZE)
+	assert(len(val) <= BTREE_MAX_VAL_SIZE)
+
+	// compressed before the commit, which holds the lock
+	stored, vflags, err := valueEncode(codec, val)
+	if err != nil {
+		return err
+	}
+	req := commitReq{key: key, val: stored, vflags: vflags}
+	groupCommit(db, &req)
+	return req.err
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	if readOnly(db) {
+		return false, ErrReadOnly
+	}
+	assert(len(key) != 0)
+	assert(len(key) <= BTREE_MAX_KEY_SIZE)
+
+	req := commitReq{key: key, del: true}
+	groupCommit(db, &req)
+	return req.deleted, req.err
 }
 
 func flushPages(db *KV) error {
+	if err := fatalCheck(db); err != nil {
+		rollback(db)
+		return err
+	}
+	historyBegin(db)
 	if err := writePages(db); err != nil {
+		rollback(db)
 		return err
 	}
 	return syncPages(db)
 }
 
+// record a value that can't be decoded, found by a read that may only
+// hold the lock shared. The next write makes it `fatal`.
+func (db *KV) valueCorrupt(err error) {
+	db.corrupt.CompareAndSwap(nil, &err)
+}
+
+// the error that fails every write, with the lock held
+func fatalCheck(db *KV) error {
+	if p := db.corrupt.Load(); p != nil && db.fatal == nil {
+		db.fatal = *p
+	}
+	return db.fatal
+}
+
+// go back to the last commit after a failed one, the pages written by
+// the failed commit are free in the last one
+func rollback(db *KV) {
+	db.tree.root = db.last.root
+	db.meta.root = db.last.meta
+	db.free.head = db.last.free
+	db.pending = db.last.pending
+	db.page.flushed = db.last.flushed
+	db.version = db.last.version
+	db.history.on = false // the entry may have gone with the commit
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.page.holes = nil
+	db.page.released = nil
+	db.page.held = db.page.held[:db.last.held]
+
+	// the WAL has the commits made since the last checkpoint
+	if db.wal.fp != nil {
+		if err := walReplay(db); err != nil {
+			db.fatal = fmt.Errorf("replay WAL: %w", err)
+		}
+	}
+}
+
+func commitDone(db *KV) {
+	db.last.root = db.tree.root
+	db.last.meta = db.meta.root
+	db.last.free = db.free.head
+	db.last.pending = db.pending
+	db.last.flushed = db.page.flushed
+	db.last.version = db.version
+	db.last.held = len(db.page.held)
+}
+
 func writePages(db *KV) error {
 	freed := []uint64{}
 	for ptr, page := range db.page.updates {
@@ -227,36 +629,69 @@ func writePages(db *KV) error {
 			freed = append(freed, ptr)
 		}
 	}
-	db.free.Update(db.page.nfree, freed)
+	if deferFree(db) {
+		pendingPush(db, freed, db.version + 1, db.pageNew)
+		freed = nil
+	}
+	db.free.Update(db.page.nfree, append(freed, db.page.released...))
 
 	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFile(db, npages); err != nil {
 		return err
 	}
-	if err := extendMmap(db, npages); err != nil {
+	// the file only shrinks once a compaction committed, a failed one
+	// goes back to the pages past `npages`
+	if err := db.pager.Resize(db.fileSize / BTREE_PAGE_SIZE); err != nil {
+		return err
+	}
+	if err := fillHoles(db); err != nil {
 		return err
 	}
 
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(pageGetMapped(db, ptr).data, page)
+			if db.crypt == nil {
+				pageStampSet(page, db.version + 1)
+			}
+			err := db.pager.WriteAt(page, int64(ptr * BTREE_PAGE_SIZE))
+			if err != nil {
+				return fmt.Errorf("write page: %w", err)
+			}
 		}
 	}
 	return nil
 }
 
 func syncPages(db *KV) error {
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	// the data pages reach the disk before the master page
+	if err := syncFile(db); err != nil {
+		rollback(db)
+		return err
 	}
+	since, pages := db.last.version, db.page.updates
 	db.page.flushed += uint64(db.page.nappend)
+	db.version++
+	db.page.nfree = 0
+	db.page.nappend = 0
 	db.page.updates = map[uint64][]byte{}
+	db.page.holes = nil
+	db.page.released = nil
 
+	if db.opts.SyncMode == SyncPeriodic {
+		commitDone(db)
+		replPublish(db, since, pages)
+		return nil // the master page is written by `syncLoop`
+	}
 	if err := masterStore(db); err != nil {
+		rollback(db)
 		return err
 	}
-	if err := db.fp.Sync(); err != nil {
-		return err
+	// the master page may reach the disk whatever happens next
+	db.synced = db.version
+	commitDone(db)
+	if err := syncFile(db); err != nil {
+		return err // the followers catch up with the next commit
 	}
+	replPublish(db, since, pages)
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,49 @@
+package pandora_db
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var ErrLocked = errors.New("database is locked by another process")
+
+// take an exclusive lock for writers and a shared one for readers,
+// waiting up to `LockTimeout` for other processes to release theirs.
+// Readers of a multi-process database register in the reader table
+// instead and may run alongside the writer.
+func lockFile(db *KV) error {
+	if db.opts.InMemory {
+		return nil
+	}
+	how := syscall.LOCK_EX
+	if db.opts.ReadOnly {
+		if db.opts.MultiProcess {
+			return nil
+		}
+		how = syscall.LOCK_SH
+	}
+
+	deadline := time.Now().Add(db.opts.LockTimeout)
+	for {
+		err := syscall.Flock(int(db.fp.Fd()), how | syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			return fmt.Errorf("flock: %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func unlockFile(db *KV) {
+	if db.opts.InMemory {
+		return
+	}
+	_ = syscall.Flock(int(db.fp.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+package pandora_db
+
+// The meta tree holds the internal data of the database next to the
+// tree of the user's keys, its root is in the master page. The first
+// byte of a meta key tells what the entry is.
+const (
+	META_TTL = 't' // the expiry index, see `ttlKey`
+	META_BUCKET = 'b' // the catalog of buckets, see `bucketKey`
+	META_CHANGES = 'c' // the changelog, see `changeKey`
+	META_HISTORY = 'h' // the writers of the file, see `historyKey`
+)
+
+func metaKey(kind byte, parts ...[]byte) []byte {
+	key := []byte{kind}
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+	return key
+}
@@ -2,54 +2,88 @@ package pandora_db
 
 import (
 	"fmt"
-	"os"
 	"syscall"
 )
 
-func mmapInit(fp *os.File) (int, []byte, error) {
-	fi, err := fp.Stat()
-
-	if err != nil {
-		return 0, nil, fmt.Errorf("stat: %w", err)
-	}
-
-	if fi.Size() % BTREE_PAGE_SIZE != 0 {
-		return 0, nil, fmt.Errorf("File size is not multiple of page size")
-	}
+// mmapPager maps the file in chunks that double the mapped size, the
+// mapping is only read and pages are written with `File.WriteAt`
+type mmapPager struct {
+	fp File
+	total int // mmap size
+	chunks [][]byte // mmap data
+}
 
-	mmapSize := 64 << 20
-	assert(mmapSize % BTREE_PAGE_SIZE == 0)
-	for mmapSize < int(fi.Size()) {
+func openMmapPager(fp File, npages int, mmapSize int) (*mmapPager, error) {
+	assert(mmapSize > 0 && mmapSize % BTREE_PAGE_SIZE == 0)
+	for mmapSize < npages * BTREE_PAGE_SIZE {
 		mmapSize *= 2
 	}
 
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize,
-		syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, syscall.PROT_READ, syscall.MAP_SHARED)
 
 	if err != nil {
-		return 0, nil, fmt.Errorf("mmap: %w", err)
+		return nil, fmt.Errorf("mmap: %w", err)
 	}
 
-	return int(fi.Size()), chunk, nil
+	return &mmapPager{fp: fp, total: mmapSize, chunks: [][]byte{chunk}}, nil
 }
 
-func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages * BTREE_PAGE_SIZE {
-		// no need to extend
-		return nil
+func (mp *mmapPager) Page(ptr uint64) []byte {
+	start := uint64(0)
+	for _, chunk := range mp.chunks {
+		end := start + uint64(len(chunk)) / BTREE_PAGE_SIZE
+		if ptr < end {
+			offset := BTREE_PAGE_SIZE * (ptr - start)
+			return chunk[offset : offset + BTREE_PAGE_SIZE]
+		}
+		start = end
 	}
+	panic("invalid ptr")
+}
 
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+// the OS caches the mapped pages
+func (mp *mmapPager) Pin(ptr uint64) []byte {
+	return mp.Page(ptr)
+}
+
+func (mp *mmapPager) Unpin(ptr uint64) {}
+
+// the mapping never shrinks, pages past the end of the file are
+// simply not read
+func (mp *mmapPager) Resize(npages int) error {
+	for mp.total < npages * BTREE_PAGE_SIZE {
+		chunk, err := syscall.Mmap(
+			int(mp.fp.Fd()), int64(mp.total), mp.total,
+			syscall.PROT_READ, syscall.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+
+		mp.total += mp.total
+		mp.chunks = append(mp.chunks, chunk)
 	}
+	return nil
+}
 
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+func (mp *mmapPager) WriteAt(data []byte, offset int64) error {
+	_, err := mp.fp.WriteAt(data, offset)
+	return err
+}
+
+func (mp *mmapPager) Size() int {
+	return mp.total
+}
+
+func (mp *mmapPager) Cache() CacheStats {
+	return CacheStats{}
+}
+
+func (mp *mmapPager) Close() error {
+	for _, chunk := range mp.chunks {
+		err := syscall.Munmap(chunk)
+		assert(err == nil)
+	}
+	mp.chunks = nil
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,246 @@
+package pandora_db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// SyncMode trades durability for write speed. A commit is never
+// partially visible after a crash, the modes differ in which commits
+// survive one.
+type SyncMode int
+
+const (
+	// fsync the data pages, then the master page. A commit survives
+	// an OS crash or power loss once Set or Del returns.
+	SyncFull SyncMode = iota
+	// like SyncFull with fdatasync, which skips file metadata such as
+	// the modification time. Same guarantees as SyncFull.
+	SyncData
+	// write the master page and fsync every `SyncInterval` in the
+	// background. Commits after the last sync are lost on a crash of
+	// the process or the OS, pages freed since then are reused only
+	// after the next sync. Other processes see a commit once synced.
+	SyncPeriodic
+	// never fsync. Commits survive a crash of the process, an OS crash
+	// may lose any of them and corrupt the file. Meant for tests and
+	// bulk imports followed by `KV.Sync`.
+	SyncNone
+)
+
+// PagerKind picks how pages are read from the file, see `Pager`.
+type PagerKind int
+
+const (
+	// map the file, pages are read straight from the page cache of the
+	// OS. Needs address space for the whole file.
+	PagerMmap PagerKind = iota
+	// read pages with pread into a cache of `PageCacheSize` bytes with
+	// CLOCK eviction, see `Stats.Cache` for its hit rate
+	PagerPread
+	// read the whole file into memory on open and write every page to
+	// both, the file is never read again
+	PagerMemory
+)
+
+// Options of `Open`. Fields left zero take their value in
+// `DefaultOpenOptions`, except the flags: they are all off in
+// `OpenOptions{}`, which opens an existing file and fails if there is
+// none. Set CreateIfMissing, or pass nil options, to create one.
+type OpenOptions struct {
+	ReadOnly bool
+	CreateIfMissing bool // on in `DefaultOpenOptions`, off if zero
+	ErrorIfExists bool
+	FileMode os.FileMode // permissions of a newly created file, 0644 if zero
+	InitialMmapSize int // size of the first mapping, 64MB if zero
+	Pager PagerKind
+	PageCacheSize int // bytes of pages cached by PagerPread, 64MB if zero
+	SyncMode SyncMode
+	SyncInterval time.Duration // how often SyncPeriodic syncs, 100ms if zero
+	PageSize int // only BTREE_PAGE_SIZE is supported, zero means the same
+	OpenFile OpenFileFunc // opens the data and WAL files, `OpenOSFile` if nil
+	LockTimeout time.Duration // how long to wait for another process to unlock the file
+	// log commits to a "-wal" file and copy them to the main file once
+	// it grows past `WALCheckpointSize`, one fsync per commit
+	WAL bool
+	WALCheckpointSize int // 4MB if zero
+	// share the file between one writer and reader processes through a
+	// table of readers in the "-lock" file, all of them must set this
+	MultiProcess bool
+	// keep the database in memory with PagerMemory, the path is ignored
+	// and nothing is written to the disk until `KV.SaveTo`
+	InMemory bool
+	// AES key of 16, 24 or 32 bytes that encrypts the pages and the WAL
+	// with AES-GCM, PagerMmap is replaced with PagerPread
+	EncryptionKey []byte
+	// codec that compresses the values of `KV.Set`, see `RegisterCodec`,
+	// "" for none. Values are readable whatever the setting.
+	Compression string
+	// how often expired keys are deleted, 1s if zero, see `KV.SetWithTTL`
+	TTLSweepInterval time.Duration
+	// changes buffered for each `KV.Watch` channel, 1024 if zero
+	WatchBuffer int
+	// log every Set and Del in the file for `KV.Changes`, until
+	// `KV.TrimChanges`. Changes made while it is off are not logged.
+	ChangeLog bool
+	// address of the primary to follow, see `KV.ServeReplicas`. The
+	// commits of the primary are applied in the background, changes
+	// through the API fail with ErrReadOnly and `KV.Watch` sees none.
+	// The file has to be new, a copy of the primary made by `Restore`,
+	// or to have followed the same primary before. One whose last commit
+	// the primary doesn't have, because it was written on since, is
+	// refused, as is one behind the HISTORY_MAX_ENTRIES last writers of
+	// the primary. A catch-up goes through a "-catchup" file, which
+	// `Open` finishes after a crash.
+	Primary string
+}
+
+// options used by `KV.Open` and by `Open` without options
+func DefaultOpenOptions() OpenOptions {
+	return OpenOptions{
+		CreateIfMissing: true,
+		FileMode: 0644,
+		InitialMmapSize: 64 << 20,
+		PageCacheSize: 64 << 20,
+		SyncMode: SyncFull,
+		SyncInterval: 100 * time.Millisecond,
+		WALCheckpointSize: 4 << 20,
+		PageSize: BTREE_PAGE_SIZE,
+		OpenFile: OpenOSFile,
+		TTLSweepInterval: time.Second,
+		WatchBuffer: 1024,
+	}
+}
+
+// fill in the defaults and reject invalid combinations
+func (opts *OpenOptions) validate() error {
+	if opts.FileMode == 0 {
+		opts.FileMode = 0644
+	}
+	if opts.InitialMmapSize == 0 {
+		opts.InitialMmapSize = 64 << 20
+	}
+	if opts.PageCacheSize == 0 {
+		opts.PageCacheSize = 64 << 20
+	}
+	if opts.PageSize == 0 {
+		opts.PageSize = BTREE_PAGE_SIZE
+	}
+	if opts.OpenFile == nil {
+		opts.OpenFile = OpenOSFile
+	}
+	if opts.WALCheckpointSize == 0 {
+		opts.WALCheckpointSize = 4 << 20
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = 100 * time.Millisecond
+	}
+	if opts.TTLSweepInterval == 0 {
+		opts.TTLSweepInterval = time.Second
+	}
+	if opts.WatchBuffer == 0 {
+		opts.WatchBuffer = 1024
+	}
+
+	if opts.FileMode &^ os.ModePerm != 0 {
+		return fmt.Errorf("FileMode %v has bits other than permissions", opts.FileMode)
+	}
+	if opts.InitialMmapSize < 0 || opts.InitialMmapSize % BTREE_PAGE_SIZE != 0 {
+		return fmt.Errorf(
+			"InitialMmapSize %d is not a positive multiple of the page size",
+			opts.InitialMmapSize,
+		)
+	}
+	if opts.InMemory {
+		if opts.ReadOnly || opts.WAL || opts.MultiProcess {
+			return errors.New("InMemory can't be combined with ReadOnly, WAL or MultiProcess")
+		}
+		opts.Pager = PagerMemory
+		opts.SyncMode = SyncNone // there is nothing to sync
+	}
+	if opts.EncryptionKey != nil {
+		switch len(opts.EncryptionKey) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("EncryptionKey has %d bytes, not 16, 24 or 32", len(opts.EncryptionKey))
+		}
+		if opts.MultiProcess {
+			return errors.New("EncryptionKey can't be combined with MultiProcess")
+		}
+		// a mapping can't hold the decrypted pages
+		if opts.Pager == PagerMmap {
+			opts.Pager = PagerPread
+		}
+	}
+	if _, err := codecLookup(opts.Compression); err != nil {
+		return fmt.Errorf("Compression: %w", err)
+	}
+	if opts.Pager < PagerMmap || opts.Pager > PagerMemory {
+		return fmt.Errorf("unknown Pager %d", opts.Pager)
+	}
+	if opts.PageCacheSize < 0 {
+		return fmt.Errorf("PageCacheSize %d is negative", opts.PageCacheSize)
+	}
+	if opts.LockTimeout < 0 {
+		return fmt.Errorf("LockTimeout %v is negative", opts.LockTimeout)
+	}
+	if opts.PageSize != BTREE_PAGE_SIZE {
+		return fmt.Errorf(
+			"PageSize %d is not supported, the page size is %d",
+			opts.PageSize, BTREE_PAGE_SIZE,
+		)
+	}
+	if opts.SyncMode < SyncFull || opts.SyncMode > SyncNone {
+		return fmt.Errorf("unknown SyncMode %d", opts.SyncMode)
+	}
+	if opts.SyncInterval < 0 {
+		return fmt.Errorf("SyncInterval %v is negative", opts.SyncInterval)
+	}
+	if opts.TTLSweepInterval < 0 {
+		return fmt.Errorf("TTLSweepInterval %v is negative", opts.TTLSweepInterval)
+	}
+	if opts.WatchBuffer < 0 {
+		return fmt.Errorf("WatchBuffer %d is negative", opts.WatchBuffer)
+	}
+	if opts.WALCheckpointSize < 0 {
+		return fmt.Errorf("WALCheckpointSize %d is negative", opts.WALCheckpointSize)
+	}
+	if opts.WAL && (opts.MultiProcess || opts.SyncMode == SyncPeriodic) {
+		return errors.New("WAL can't be combined with MultiProcess or SyncPeriodic")
+	}
+	if opts.Primary != "" && (opts.ReadOnly || opts.WAL || opts.MultiProcess || opts.SyncMode == SyncPeriodic) {
+		return errors.New("Primary can't be combined with ReadOnly, WAL, MultiProcess or SyncPeriodic")
+	}
+	if opts.Primary != "" && opts.EncryptionKey != nil {
+		return errors.New("Primary can't be combined with EncryptionKey, replication sends the pages in the clear")
+	}
+	// reader processes see the commits of the writer through the mapping
+	if opts.MultiProcess && opts.Pager != PagerMmap {
+		return errors.New("MultiProcess requires PagerMmap")
+	}
+	if opts.ReadOnly && (opts.CreateIfMissing || opts.ErrorIfExists) {
+		return errors.New("ReadOnly can't be combined with CreateIfMissing or ErrorIfExists")
+	}
+	if opts.ErrorIfExists && !opts.CreateIfMissing {
+		return errors.New("ErrorIfExists requires CreateIfMissing")
+	}
+	return nil
+}
+
+// open the database at `path`, nil options mean `DefaultOpenOptions`,
+// see `OpenOptions` for the zero values
+func Open(path string, opts *OpenOptions) (*KV, error) {
+	db := &KV{Path: path}
+	if opts == nil {
+		db.opts = DefaultOpenOptions()
+	} else {
+		db.opts = *opts
+	}
+
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
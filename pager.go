@@ -0,0 +1,110 @@
+package pandora_db
+
+import (
+	"fmt"
+	"io"
+)
+
+// Pager is how the database reads the pages of its file. The tree and
+// the free list get their pages from `KV.pageGet`, which asks the
+// pager for the flushed ones.
+type Pager interface {
+	// the page `ptr`, below the last `Resize`. The slice is only read
+	// and stays valid until `Close`, it may change when the page is
+	// written again.
+	Page(ptr uint64) []byte
+	// like `Page`, and the page stays cached until `Unpin`
+	Pin(ptr uint64) []byte
+	Unpin(ptr uint64)
+	// make `npages` pages readable after the file grew or shrank
+	Resize(npages int) error
+	// write through to the file, `Page` sees the new content
+	WriteAt(data []byte, offset int64) error
+	// bytes mapped or cached
+	Size() int
+	Cache() CacheStats
+	Close() error
+}
+
+func openPager(db *KV, npages int) (Pager, error) {
+	switch db.opts.Pager {
+	case PagerPread:
+		return openPreadPager(db.fp, db.opts.PageCacheSize), nil
+	case PagerMemory:
+		return openFullCachePager(db.fp, npages)
+	default:
+		return openMmapPager(db.fp, npages, db.opts.InitialMmapSize)
+	}
+}
+
+// fullCachePager caches the whole file: every page is read on open
+// and writes go through to the file as well as to the cache, so pages
+// are never read again. With `OpenOptions.InMemory` the file is a
+// `memFile` that keeps nothing and the cache is all there is.
+type fullCachePager struct {
+	fp File
+	pages [][]byte
+}
+
+func openFullCachePager(fp File, npages int) (*fullCachePager, error) {
+	cp := &fullCachePager{fp: fp}
+	for ptr := 0; ptr < npages; ptr++ {
+		page := make([]byte, BTREE_PAGE_SIZE)
+		_, err := fp.ReadAt(page, int64(ptr * BTREE_PAGE_SIZE))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read page: %w", err)
+		}
+		cp.pages = append(cp.pages, page)
+	}
+	return cp, nil
+}
+
+func (cp *fullCachePager) Page(ptr uint64) []byte {
+	if ptr >= uint64(len(cp.pages)) {
+		panic("invalid ptr")
+	}
+	return cp.pages[ptr]
+}
+
+func (cp *fullCachePager) Pin(ptr uint64) []byte {
+	return cp.Page(ptr)
+}
+
+func (cp *fullCachePager) Unpin(ptr uint64) {}
+
+func (cp *fullCachePager) Resize(npages int) error {
+	for len(cp.pages) < npages {
+		cp.pages = append(cp.pages, make([]byte, BTREE_PAGE_SIZE))
+	}
+	cp.pages = cp.pages[:npages]
+	return nil
+}
+
+func (cp *fullCachePager) WriteAt(data []byte, offset int64) error {
+	if _, err := cp.fp.WriteAt(data, offset); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		ptr := offset / BTREE_PAGE_SIZE
+		if ptr >= int64(len(cp.pages)) {
+			cp.Resize(int(ptr) + 1)
+		}
+		n := copy(cp.pages[ptr][offset % BTREE_PAGE_SIZE:], data)
+		data = data[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+func (cp *fullCachePager) Size() int {
+	return len(cp.pages) * BTREE_PAGE_SIZE
+}
+
+func (cp *fullCachePager) Cache() CacheStats {
+	return CacheStats{}
+}
+
+func (cp *fullCachePager) Close() error {
+	cp.pages = nil
+	return nil
+}
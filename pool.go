@@ -0,0 +1,134 @@
+package pandora_db
+
+// page cache counters of a pager, zero for pagers without a cache
+type CacheStats struct {
+	Hits uint64
+	Misses uint64
+	Evictions uint64
+	Pinned int // pages that can't be evicted right now
+}
+
+type poolFrame struct {
+	ptr uint64
+	page []byte
+	used bool // read since the clock hand last passed
+	pins int
+}
+
+// bufferPool holds up to `limit` pages and evicts with the CLOCK
+// algorithm: the hand clears the `used` bit of the frames it passes
+// and takes the first one without it. Pinned frames are skipped, the
+// pool grows past its limit when every frame is pinned. Not safe for
+// concurrent use.
+type bufferPool struct {
+	limit int // in pages
+	frames []*poolFrame
+	index map[uint64]int // page to frame
+	hand int
+	stats CacheStats
+}
+
+func newBufferPool(limit int) *bufferPool {
+	if limit < 1 {
+		limit = 1
+	}
+	return &bufferPool{limit: limit, index: map[uint64]int{}}
+}
+
+// the cached page, counting a hit or a miss
+func poolGet(pool *bufferPool, ptr uint64) *poolFrame {
+	i, ok := pool.index[ptr]
+	if !ok {
+		pool.stats.Misses++
+		return nil
+	}
+	pool.stats.Hits++
+	frame := pool.frames[i]
+	frame.used = true
+	return frame
+}
+
+// cache `page`, replacing the cached copy
+func poolPut(pool *bufferPool, ptr uint64, page []byte) *poolFrame {
+	if i, ok := pool.index[ptr]; ok {
+		frame := pool.frames[i]
+		frame.page = page
+		frame.used = true
+		return frame
+	}
+
+	// after every frame was pinned the pool may be past its limit
+	for len(pool.frames) >= pool.limit && poolEvict(pool) {
+	}
+	frame := &poolFrame{ptr: ptr, page: page, used: true}
+	pool.index[ptr] = len(pool.frames)
+	pool.frames = append(pool.frames, frame)
+	return frame
+}
+
+// remove the frame under the clock hand, false if all are pinned
+func poolEvict(pool *bufferPool) bool {
+	// two turns clear every `used` bit
+	for n := 0; n < 2 * len(pool.frames); n++ {
+		if pool.hand >= len(pool.frames) {
+			pool.hand = 0
+		}
+		frame := pool.frames[pool.hand]
+		if frame.pins > 0 {
+			pool.hand++
+			continue
+		}
+		if frame.used {
+			frame.used = false
+			pool.hand++
+			continue
+		}
+		poolRemove(pool, pool.hand)
+		pool.stats.Evictions++
+		return true
+	}
+	return false
+}
+
+// the last frame takes the place of the removed one
+func poolRemove(pool *bufferPool, i int) {
+	frame := pool.frames[i]
+	if frame.pins > 0 {
+		pool.stats.Pinned--
+	}
+	delete(pool.index, frame.ptr)
+	last := len(pool.frames) - 1
+	pool.frames[i] = pool.frames[last]
+	pool.frames = pool.frames[:last]
+	if i < last {
+		pool.index[pool.frames[i].ptr] = i
+	}
+}
+
+func poolUnpin(pool *bufferPool, ptr uint64) {
+	i, ok := pool.index[ptr]
+	if !ok {
+		return // dropped by `poolTruncate`
+	}
+	frame := pool.frames[i]
+	assert(frame.pins > 0)
+	frame.pins--
+	if frame.pins == 0 {
+		pool.stats.Pinned--
+	}
+}
+
+// drop the pages from `npages` on, pinned or not
+func poolTruncate(pool *bufferPool, npages int) {
+	for i := 0; i < len(pool.frames); {
+		frame := pool.frames[i]
+		if frame.ptr < uint64(npages) {
+			i++
+			continue
+		}
+		poolRemove(pool, i)
+	}
+	if pool.hand >= len(pool.frames) {
+		pool.hand = 0
+	}
+}
@@ -0,0 +1,123 @@
+package pandora_db
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// preadPager reads pages with `File.ReadAt` into a `bufferPool` and
+// needs no address space for the file. Cached pages are never
+// modified, a write replaces them, so a page handed out stays intact
+// after it is evicted.
+type preadPager struct {
+	fp File
+	mu sync.Mutex // readers share the pool
+	pool *bufferPool
+}
+
+func openPreadPager(fp File, limit int) *preadPager {
+	return &preadPager{fp: fp, pool: newBufferPool(limit / BTREE_PAGE_SIZE)}
+}
+
+// a page that can't be read, a short read or one that fails decryption.
+// The pager panics with it, the commit of a batch recovers it and fails
+// the batch, see `commitBatch`.
+type pageReadError struct {
+	ptr uint64
+	err error
+}
+
+func (e *pageReadError) Error() string {
+	return fmt.Sprintf("read page %d: %v", e.ptr, e.err)
+}
+
+func (e *pageReadError) Unwrap() error {
+	return e.err
+}
+
+func preadFrame(pp *preadPager, ptr uint64) *poolFrame {
+	if frame := poolGet(pp.pool, ptr); frame != nil {
+		return frame
+	}
+	page := make([]byte, BTREE_PAGE_SIZE)
+	_, err := pp.fp.ReadAt(page, int64(ptr * BTREE_PAGE_SIZE))
+	if err != nil && err != io.EOF {
+		panic(&pageReadError{ptr, err})
+	}
+	return poolPut(pp.pool, ptr, page)
+}
+
+func (pp *preadPager) Page(ptr uint64) []byte {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return preadFrame(pp, ptr).page
+}
+
+func (pp *preadPager) Pin(ptr uint64) []byte {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	frame := preadFrame(pp, ptr)
+	if frame.pins == 0 {
+		pp.pool.stats.Pinned++
+	}
+	frame.pins++
+	return frame.page
+}
+
+func (pp *preadPager) Unpin(ptr uint64) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	poolUnpin(pp.pool, ptr)
+}
+
+// drop the pages past the end of the file
+func (pp *preadPager) Resize(npages int) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	poolTruncate(pp.pool, npages)
+	return nil
+}
+
+func (pp *preadPager) WriteAt(data []byte, offset int64) error {
+	if _, err := pp.fp.WriteAt(data, offset); err != nil {
+		return err
+	}
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for len(data) > 0 {
+		ptr := uint64(offset / BTREE_PAGE_SIZE)
+		page := make([]byte, BTREE_PAGE_SIZE)
+		start := int(offset % BTREE_PAGE_SIZE)
+		i, ok := pp.pool.index[ptr]
+		if ok {
+			copy(page, pp.pool.frames[i].page)
+		}
+		n := copy(page[start:], data)
+		// a partly written page is only cached if the rest is known
+		if ok || n == BTREE_PAGE_SIZE {
+			poolPut(pp.pool, ptr, page)
+		}
+		data = data[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+func (pp *preadPager) Size() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return len(pp.pool.frames) * BTREE_PAGE_SIZE
+}
+
+func (pp *preadPager) Cache() CacheStats {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.pool.stats
+}
+
+func (pp *preadPager) Close() error {
+	pp.pool = nil
+	return nil
+}
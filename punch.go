@@ -0,0 +1,98 @@
+package pandora_db
+
+import (
+	"fmt"
+	"sort"
+)
+
+const FALLOC_FL_KEEP_SIZE = 0x01
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
+// PunchHoles gives the disk space of the pages sitting in the free list
+// back to the file system without changing the file size. Released
+// pages are marked in the list and get their space allocated again
+// when they are reused.
+func (db *KV) PunchHoles() error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if full, err := beginFullSync(db); err != nil {
+		return fmt.Errorf("KV.PunchHoles: %w", err)
+	} else if full {
+		defer endFullSync(db)
+	}
+	if db.wal.fp != nil {
+		if err := checkpoint(db); err != nil {
+			return fmt.Errorf("KV.PunchHoles: %w", err)
+		}
+	}
+	assert(len(db.page.updates) == 0)
+
+	free, nodes := db.free.List()
+	sort.Slice(free, func(i, j int) bool {
+		return free[i] & FREE_LIST_PUNCHED < free[j] & FREE_LIST_PUNCHED
+	})
+	todo := 0
+	for todo < len(free) && free[todo] & FREE_LIST_PUNCHED == 0 {
+		todo++
+	}
+
+	// the list is rewritten with the marks set, its new pages are taken
+	// from the list itself, preferably from the pages not punched yet.
+	// Nothing is left to punch if those take every one of them.
+	k := (len(free) + len(nodes) + FREE_LIST_CAP - 1) / FREE_LIST_CAP
+	if todo <= k {
+		return nil
+	}
+	content := []uint64{}
+	for _, ptr := range free[k:] {
+		content = append(content, ptr | FREE_LIST_PUNCHED)
+	}
+	// the old list pages are still in use until the commit
+	content = append(content, nodes...)
+
+	db.free.Reset(content, free[:k])
+	if err := flushPages(db); err != nil {
+		return fmt.Errorf("KV.PunchHoles: %w", err)
+	}
+
+	holes := free[k:todo]
+	sort.Slice(holes, func(i, j int) bool { return holes[i] < holes[j] })
+	for len(holes) > 0 {
+		n := 1
+		for n < len(holes) && holes[n] == holes[0] + uint64(n) {
+			n++
+		}
+		err := db.fp.Allocate(
+			FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE,
+			int64(holes[0] * BTREE_PAGE_SIZE), int64(n * BTREE_PAGE_SIZE),
+		)
+		if err != nil {
+			return fmt.Errorf("KV.PunchHoles: fallocate: %w", err)
+		}
+		holes = holes[n:]
+	}
+	return nil
+}
+
+// strip the mark from a free list pointer that is being reused,
+// its disk space is allocated again before the page is written
+func pageReclaim(db *KV, ptr uint64) uint64 {
+	if ptr & FREE_LIST_PUNCHED != 0 {
+		ptr &^= FREE_LIST_PUNCHED
+		db.page.holes = append(db.page.holes, ptr)
+	}
+	return ptr
+}
+
+func fillHoles(db *KV) error {
+	for _, ptr := range db.page.holes {
+		err := db.fp.Allocate(0, int64(ptr * BTREE_PAGE_SIZE), BTREE_PAGE_SIZE)
+		if err != nil {
+			return fmt.Errorf("fallocate: %w", err)
+		}
+	}
+	return nil
+}
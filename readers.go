@@ -0,0 +1,328 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const READERS_SIG = "PANDORA_READERS\x00"
+const READERS_SIZE = 4096
+const READER_SLOT = 16
+const READER_SLOTS = (READERS_SIZE - len(READERS_SIG)) / READER_SLOT
+
+var ErrTooManyReaders = errors.New("no free slot in the reader table")
+var ErrNothingCommitted = errors.New("nothing committed yet")
+
+// Reader table in the "-lock" file, shared by all processes
+// | sig | slots: | pid | version | |
+// | 16B |        |  8B |    8B   | |
+// A reader stores the version of the master page it reads from into
+// its slot, zero means it is idle.
+type readerTable struct {
+	fp *os.File
+	data []byte
+	slot int
+}
+
+func readerWord(rt *readerTable, slot int, field int) *uint64 {
+	offset := len(READERS_SIG) + slot * READER_SLOT + field * 8
+	return (*uint64)(unsafe.Pointer(&rt.data[offset]))
+}
+
+func readerAlive(pid uint64) bool {
+	err := syscall.Kill(int(pid), 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func openReaders(db *KV) error {
+	fp, err := os.OpenFile(db.Path + "-lock", os.O_RDWR | os.O_CREATE, db.opts.FileMode)
+	if err != nil {
+		return fmt.Errorf("open lock file: %w", err)
+	}
+	rt := &readerTable{fp: fp, slot: -1}
+
+	// the first process sets up the table under an exclusive lock
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX); err != nil {
+		_ = fp.Close()
+		return fmt.Errorf("flock: %w", err)
+	}
+	fi, err := fp.Stat()
+	if err == nil && fi.Size() < READERS_SIZE {
+		err = fp.Truncate(READERS_SIZE)
+		if err == nil {
+			_, err = fp.WriteAt([]byte(READERS_SIG), 0)
+		}
+	}
+	if err == nil {
+		rt.data, err = syscall.Mmap(
+			int(fp.Fd()), 0, READERS_SIZE,
+			syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_SHARED,
+		)
+	}
+	_ = syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		_ = fp.Close()
+		return fmt.Errorf("reader table: %w", err)
+	}
+	if string(rt.data[:len(READERS_SIG)]) != READERS_SIG {
+		_ = syscall.Munmap(rt.data)
+		_ = fp.Close()
+		return errors.New("Bad reader table signature")
+	}
+	db.readers = rt
+
+	if !db.opts.ReadOnly {
+		return nil
+	}
+
+	// take a free slot, or one left behind by a dead process
+	pid := uint64(os.Getpid())
+	for i := 0; i < READER_SLOTS && rt.slot < 0; i++ {
+		owner := readerWord(rt, i, 0)
+		old := atomic.LoadUint64(owner)
+		if old != 0 && readerAlive(old) {
+			continue
+		}
+		if atomic.CompareAndSwapUint64(owner, old, pid) {
+			atomic.StoreUint64(readerWord(rt, i, 1), 0)
+			rt.slot = i
+		}
+	}
+	if rt.slot < 0 {
+		return ErrTooManyReaders
+	}
+	return nil
+}
+
+func closeReaders(db *KV) {
+	rt := db.readers
+	if rt.slot >= 0 {
+		atomic.StoreUint64(readerWord(rt, rt.slot, 1), 0)
+		atomic.StoreUint64(readerWord(rt, rt.slot, 0), 0)
+	}
+	_ = syscall.Munmap(rt.data)
+	_ = rt.fp.Close()
+	db.readers = nil
+}
+
+// the oldest version some reader or backup may still be looking at
+func oldestReader(db *KV) uint64 {
+	oldest := uint64(math.MaxUint64)
+	for _, version := range db.backups {
+		if version < oldest {
+			oldest = version
+		}
+	}
+	if db.readers == nil {
+		return oldest
+	}
+
+	rt := db.readers
+	for i := 0; i < READER_SLOTS; i++ {
+		owner := readerWord(rt, i, 0)
+		pid := atomic.LoadUint64(owner)
+		if pid == 0 {
+			continue
+		}
+		if !readerAlive(pid) {
+			atomic.CompareAndSwapUint64(owner, pid, 0)
+			continue
+		}
+		version := atomic.LoadUint64(readerWord(rt, i, 1))
+		if version != 0 && version < oldest {
+			oldest = version
+		}
+	}
+	return oldest
+}
+
+// get from the latest commit in a reader process
+func readerGet(db *KV, key []byte) ([]byte, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !readerPin(db) {
+		return nil, false
+	}
+	defer readerUnpin(db)
+	val, ok := db.tree.Get(key)
+	// the page may be reused by the writer once unpinned
+	return append([]byte{}, val...), ok
+}
+
+// scan the latest commit in a reader process
+func readerScan(db *KV, start []byte, fn func(key []byte, val []byte) bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !readerPin(db) {
+		return
+	}
+	defer readerUnpin(db)
+	db.tree.Scan(start, fn)
+}
+
+// switch to the latest commit and publish its version in the reader
+// table, so that the writer keeps its pages until `readerUnpin`
+func readerPin(db *KV) bool {
+	if db.fileSize < BTREE_PAGE_SIZE {
+		size, err := db.fp.Size()
+		if err != nil || size < BTREE_PAGE_SIZE {
+			return false // nothing committed yet
+		}
+		db.fileSize = int(size)
+	}
+
+	rt := db.readers
+	slot := readerWord(rt, rt.slot, 1)
+	for {
+		version := masterVersion(db)
+		atomic.StoreUint64(slot, version)
+		err := readerRefresh(db)
+		// the writer may have committed in the meantime and missed the slot
+		if masterVersion(db) != version {
+			continue
+		}
+		if err != nil || db.version != version {
+			atomic.StoreUint64(slot, 0)
+			return false
+		}
+		return true
+	}
+}
+
+// the version of the last commit in the file, a copy of the master
+// page being written fails its checksum and the other one is used
+func masterVersion(db *KV) uint64 {
+	data := db.pager.Page(0)
+	slot := masterPick(data)
+	if slot < 0 {
+		return 0
+	}
+	return masterField(data, slot, MASTER_VERSION)
+}
+
+func readerUnpin(db *KV) {
+	atomic.StoreUint64(readerWord(db.readers, db.readers.slot, 1), 0)
+}
+
+// pick up the commits made by the writer process
+func readerRefresh(db *KV) error {
+	data := db.pager.Page(0)
+	slot := masterPick(data)
+	if slot < 0 {
+		return masterLoad(db) // empty or broken
+	}
+	if masterField(data, slot, MASTER_VERSION) == db.version {
+		return nil
+	}
+
+	used := masterField(data, slot, MASTER_USED)
+	if used > uint64(db.fileSize / BTREE_PAGE_SIZE) {
+		size, err := db.fp.Size()
+		if err != nil {
+			return err
+		}
+		db.fileSize = int(size)
+	}
+	if err := db.pager.Resize(int(used)); err != nil {
+		return err
+	}
+	return masterLoad(db)
+}
+
+// pending node structure, same as a free list node with the version
+// of the commit that freed the pages in place of the total
+// | type | size | version | next |  pointers |
+// |  2B  |  2B  |    8B   |  8B  | size * 8B |
+func pnVersion(node BNode) uint64 {
+	return binary.LittleEndian.Uint64(node.data[4:])
+}
+
+// add the pages freed by commit `version` to the pending list
+func pendingPush(db *KV, ptrs []uint64, version uint64, new func(BNode) uint64) {
+	for len(ptrs) > 0 {
+		node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+
+		size := len(ptrs)
+		if size > FREE_LIST_CAP {
+			size = FREE_LIST_CAP
+		}
+		flnSetHeader(node, uint16(size), db.pending)
+		flnSetTotal(node, version)
+		for i := 0; i < size; i++ {
+			flnSetPtr(node, i, ptrs[i])
+		}
+		ptrs = ptrs[size:]
+
+		db.pending = new(node)
+	}
+}
+
+// all pages in the pending list, including the list itself
+func pendingList(db *KV) []uint64 {
+	ptrs := []uint64{}
+	for next := db.pending; next != 0; {
+		node := db.pageGet(next)
+		ptrs = append(ptrs, next)
+		for i := 0; i < flnSize(node); i++ {
+			ptrs = append(ptrs, flnPtr(node, i))
+		}
+		next = flnNext(node)
+	}
+	return ptrs
+}
+
+// move the pages that neither a reader nor the master page on disk
+// can see anymore to `page.released`, they go to the free list with
+// the next commit
+func pendingRelease(db *KV) {
+	releaseHeld(db)
+	if db.pending == 0 {
+		return
+	}
+	oldest := oldestReader(db)
+	if db.opts.SyncMode == SyncPeriodic && db.synced < oldest {
+		oldest = db.synced
+	}
+
+	// newer versions come first
+	kept := []uint64{}
+	next := db.pending
+	for next != 0 {
+		node := db.pageGet(next)
+		if pnVersion(node) <= oldest {
+			break
+		}
+		kept = append(kept, next)
+		next = flnNext(node)
+	}
+	if next == 0 {
+		return
+	}
+	for next != 0 {
+		node := db.pageGet(next)
+		pageRelease(db, next)
+		for i := 0; i < flnSize(node); i++ {
+			db.page.released = append(db.page.released, flnPtr(node, i))
+		}
+		next = flnNext(node)
+	}
+
+	// copy the kept part so that it ends before the released one
+	db.pending = 0
+	for i := len(kept) - 1; i >= 0; i-- {
+		old := db.pageGet(kept[i])
+		node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		copy(node.data, old.data)
+		flnSetHeader(node, uint16(flnSize(old)), db.pending)
+		db.pending = db.pageNew(node)
+		pageRelease(db, kept[i])
+	}
+}
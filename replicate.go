@@ -0,0 +1,509 @@
+package pandora_db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const FOLLOW_SIG = "PANDORA_FOLLOW2\x00"
+// commits queued for a follower, one that falls further behind is
+// disconnected and catches up when it connects again
+const REPL_BUFFER = 1024
+// how long a follower waits before it connects again
+const FOLLOW_RETRY = time.Second
+const FOLLOW_HELLO_TIMEOUT = 10 * time.Second
+// file next to the database holding a catch-up being applied
+const FOLLOW_CATCHUP_SUFFIX = "-catchup"
+
+// Replication stream. A follower connects to the primary and sends
+// | sig | version | history |
+// | 16B |    8B   |   16B   |
+// with its last commit and the id of its last history entry, see
+// `historyKey`. A primary that doesn't have the commit closes the
+// connection, otherwise it answers with a backup of the commits after
+// it, like `KV.BackupSince`, with the free and pending
+// lists of the primary instead of a new free list. Then every commit
+// written to the file of the primary follows as a backup of its own,
+// made of the pages of `page.updates` and the master page. The
+// follower applies each one like a commit, the ones it has already are
+// skipped. Pages are numbered like in the file of the primary, so a
+// follower is a copy of it. A commit only writes pages free in the one
+// before, but the catch-up spans many commits of the primary and may
+// overwrite pages of the last commit of the follower, it goes through
+// the "-catchup" file first, see `followStage`.
+type replica struct {
+	conn net.Conn
+	ch chan []byte // commits waiting to be sent
+	closed bool
+}
+
+// ServeReplicas sends the commits of the database to the followers
+// that connect to `ln`, see `OpenOptions.Primary`, until `ln` fails.
+// `Close` closes it. In WAL mode the followers get the commits once
+// checkpointed. With SyncPeriodic the list pages held until the next
+// sync are missing from the lists of the followers until the primary
+// frees them. Encrypted databases are not supported, the pages would
+// go over the network in the clear.
+func (db *KV) ServeReplicas(ln net.Listener) error {
+	if err := serveReplicas(db, ln); err != nil {
+		return fmt.Errorf("KV.ServeReplicas: %w", err)
+	}
+	return nil
+}
+
+func serveReplicas(db *KV, ln net.Listener) error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	if db.crypt != nil {
+		return errors.New("replication of an encrypted database is not supported")
+	}
+	db.repl.mu.Lock()
+	if db.repl.closed {
+		db.repl.mu.Unlock()
+		return net.ErrClosed
+	}
+	db.repl.listeners = append(db.repl.listeners, ln)
+	db.repl.mu.Unlock()
+	// the next commit adds the history entry the followers check
+	db.mu.Lock()
+	db.history.want = true
+	db.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		db.repl.mu.Lock()
+		if db.repl.closed {
+			db.repl.mu.Unlock()
+			_ = conn.Close()
+			return net.ErrClosed
+		}
+		db.repl.serving.Add(1)
+		db.repl.mu.Unlock()
+		go func() {
+			defer db.repl.serving.Done()
+			replServe(db, conn)
+		}()
+	}
+}
+
+// catch a follower up, then send it the commits as they come
+func replServe(db *KV, conn net.Conn) {
+	defer conn.Close()
+	hello := make([]byte, len(FOLLOW_SIG) + 8 + HISTORY_ID_SIZE)
+	_ = conn.SetReadDeadline(time.Now().Add(FOLLOW_HELLO_TIMEOUT))
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return
+	}
+	if string(hello[:len(FOLLOW_SIG)]) != FOLLOW_SIG {
+		return
+	}
+	since := binary.LittleEndian.Uint64(hello[len(FOLLOW_SIG):])
+	history := hello[len(FOLLOW_SIG) + 8:]
+
+	// the commits from now on are queued, the follower skips those
+	// in the catch-up
+	r := &replica{conn: conn, ch: make(chan []byte, REPL_BUFFER)}
+	db.repl.mu.Lock()
+	if db.repl.closed {
+		db.repl.mu.Unlock()
+		return
+	}
+	db.repl.list = append(db.repl.list, r)
+	db.repl.mu.Unlock()
+	defer func() {
+		db.repl.mu.Lock()
+		replClose(db, r)
+		db.repl.mu.Unlock()
+	}()
+
+	w := bufio.NewWriter(conn)
+	if err := replCatchUp(db, since, history, w); err != nil {
+		return
+	}
+	if err := w.Flush(); err != nil {
+		return
+	}
+	for msg := range r.ch {
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// write the pages changed after commit `since`, the lists and the
+// master page of the last commit
+func replCatchUp(db *KV, since uint64, history []byte, w io.Writer) error {
+	snap := &snapshot{db: db, w: w, lists: map[uint64][]byte{}}
+	unpin, err := snapshotPin(snap)
+	if err != nil {
+		return err
+	}
+	defer unpin()
+	if since > snap.version {
+		return errors.New("the follower is ahead of the primary")
+	}
+	meta := BTree{root: snap.meta, get: snap.page}
+	if err := historyCheck(&meta, since, history); err != nil {
+		return err
+	}
+
+	header := backupHeaderPack(backupHeader{since, snap.version, snap.npages})
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	live := make([]bool, snap.npages)
+	err = snap.changed(snap.root, snap.height(snap.root), false, since, true, live)
+	if err == nil {
+		err = snap.changed(snap.meta, snap.height(snap.meta), true, since, true, live)
+	}
+	if err != nil {
+		return err
+	}
+	for ptr, page := range snap.lists {
+		if err := snap.emit(ptr, page); err != nil {
+			return err
+		}
+	}
+	master := make([]byte, BTREE_PAGE_SIZE)
+	data := masterPack([]uint64{
+		snap.root, snap.npages, snap.free, snap.version, snap.pending, snap.meta,
+	})
+	copy(master, data[:])
+	return snap.emit(0, master)
+}
+
+// queue a commit for the followers, `pages` are its `page.updates`
+func replPublish(db *KV, since uint64, pages map[uint64][]byte) {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	if len(db.repl.list) == 0 {
+		return
+	}
+
+	msg := backupHeaderPack(backupHeader{since, db.version, db.page.flushed})
+	for ptr, page := range pages {
+		if page == nil {
+			continue
+		}
+		msg = binary.LittleEndian.AppendUint64(msg, ptr)
+		msg = append(msg, page...)
+		msg = append(msg, make([]byte, BTREE_PAGE_SIZE - len(page))...)
+	}
+	master := masterData(db)
+	msg = binary.LittleEndian.AppendUint64(msg, 0)
+	msg = append(msg, master[:]...)
+	msg = append(msg, make([]byte, BTREE_PAGE_SIZE - MASTER_SIZE)...)
+
+	for _, r := range append([]*replica{}, db.repl.list...) {
+		select {
+		case r.ch <- msg:
+		default:
+			replClose(db, r)
+		}
+	}
+}
+
+// with `repl.mu` held
+func replClose(db *KV, r *replica) {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.ch)
+	_ = r.conn.Close()
+	for i, other := range db.repl.list {
+		if other == r {
+			db.repl.list = append(db.repl.list[:i], db.repl.list[i + 1:]...)
+			break
+		}
+	}
+}
+
+// stop serving followers and wait for the goroutines that did
+func replCloseAll(db *KV) {
+	db.repl.mu.Lock()
+	db.repl.closed = true
+	for _, ln := range db.repl.listeners {
+		_ = ln.Close()
+	}
+	db.repl.listeners = nil
+	for len(db.repl.list) > 0 {
+		replClose(db, db.repl.list[0])
+	}
+	db.repl.mu.Unlock()
+	db.repl.serving.Wait()
+}
+
+// follow the primary until `stop`, connecting again after failures.
+// A failed write to the file stops following, see `KV.fatal`.
+func followLoop(db *KV, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		_ = follow(db, stop)
+
+		db.mu.RLock()
+		fatal := db.fatal
+		db.mu.RUnlock()
+		if fatal != nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(FOLLOW_RETRY):
+		}
+	}
+}
+
+func startFollowLoop(db *KV) {
+	db.followStop = make(chan struct{})
+	db.followDone = make(chan struct{})
+	go followLoop(db, db.followStop, db.followDone)
+}
+
+func stopFollowLoop(db *KV) {
+	close(db.followStop)
+	<-db.followDone
+	db.followStop = nil
+	db.followDone = nil
+}
+
+// apply the commits of the primary until the connection fails
+func follow(db *KV, stop chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", db.opts.Primary)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// `stop` interrupts the reads
+	context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	db.mu.RLock()
+	hello := binary.LittleEndian.AppendUint64([]byte(FOLLOW_SIG), db.version)
+	hello = append(hello, historyLast(&db.meta)...)
+	db.mu.RUnlock()
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for catchUp := true; ; catchUp = false {
+		if err := followApply(db, r, catchUp); err != nil {
+			return err
+		}
+	}
+}
+
+// read the next commit from the primary and apply it, the first one
+// is the catch-up
+func followApply(db *KV, r io.Reader, catchUp bool) error {
+	h, err := backupHeaderRead(r)
+	if err != nil {
+		return err
+	}
+	pages := map[uint64][]byte{}
+	master, err := backupPages(r, h, func(ptr uint64, page []byte) error {
+		pages[ptr] = append([]byte{}, page...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := followCheck(h, master); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if h.version <= db.version {
+		return nil // in the catch-up
+	}
+	if h.since > db.version {
+		return ErrBackupChain
+	}
+	// an empty file has no pages to lose
+	staged := catchUp && db.version > 0
+	if staged {
+		if err := followStage(db, h, pages, master); err != nil {
+			return fmt.Errorf("stage the catch-up: %w", err)
+		}
+	}
+	if err := followWrite(db, pages, master); err != nil {
+		db.fatal = fmt.Errorf("follow: %w", err)
+		return db.fatal
+	}
+	if staged {
+		// left behind, it is older than the file and ignored
+		_ = os.Remove(db.Path + FOLLOW_CATCHUP_SUFFIX)
+	}
+	return nil
+}
+
+// the master page of a commit of the primary
+func followCheck(h backupHeader, master []byte) error {
+	if !masterValid(master, 0) || masterField(master, 0, MASTER_VERSION) != h.version {
+		return errors.New("bad master page")
+	}
+	used := masterField(master, 0, MASTER_USED)
+	bad := used != h.npages || masterField(master, 0, MASTER_ROOT) >= used
+	bad = bad || masterField(master, 0, MASTER_FREE) >= used
+	bad = bad || masterField(master, 0, MASTER_PENDING) >= used
+	bad = bad || masterField(master, 0, MASTER_META) >= used
+	if bad {
+		return errors.New("bad master page")
+	}
+	return nil
+}
+
+// Catch-up file, the catch-up as received and a checksum
+// | backup stream | crc32 |
+// |      ...      |  4B   |
+// It is synced before the first page of the file is written and
+// removed once the master page is. `followRecover` applies it again
+// if the file is still at its `since`.
+func followStage(db *KV, h backupHeader, pages map[uint64][]byte, master []byte) error {
+	name := db.Path + FOLLOW_CATCHUP_SUFFIX
+	fp, err := db.opts.OpenFile(name, os.O_RDWR | os.O_CREATE | os.O_TRUNC, db.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	data := backupHeaderPack(h)
+	for ptr, page := range pages {
+		data = binary.LittleEndian.AppendUint64(data, ptr)
+		data = append(data, page...)
+	}
+	data = binary.LittleEndian.AppendUint64(data, 0)
+	data = append(data, master...)
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	_, err = fp.WriteAt(data, 0)
+	if err == nil {
+		switch db.opts.SyncMode {
+		case SyncFull:
+			err = fp.Sync()
+		case SyncData:
+			err = fp.Datasync()
+		}
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && db.opts.SyncMode != SyncNone {
+		err = syncDir(name)
+	}
+	return err
+}
+
+// finish a catch-up cut short by a crash, before the file is used
+func followRecover(db *KV) error {
+	name := db.Path + FOLLOW_CATCHUP_SUFFIX
+	fp, err := db.opts.OpenFile(name, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open catch-up file: %w", err)
+	}
+	size, err := fp.Size()
+	data := make([]byte, max(size, 0))
+	if err == nil {
+		_, err = fp.ReadAt(data, 0)
+	}
+	_ = fp.Close()
+	if err != nil {
+		return fmt.Errorf("read catch-up file: %w", err)
+	}
+
+	// torn while being written, the file wasn't touched yet
+	n := len(data) - 4
+	if n < 0 || crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return followRemove(db, name)
+	}
+	r := bytes.NewReader(data[:n])
+	h, err := backupHeaderRead(r)
+	if err != nil {
+		return err
+	}
+	pages := map[uint64][]byte{}
+	master, err := backupPages(r, h, func(ptr uint64, page []byte) error {
+		pages[ptr] = append([]byte{}, page...)
+		return nil
+	})
+	if err == nil {
+		err = followCheck(h, master)
+	}
+	if err != nil {
+		return fmt.Errorf("catch-up file: %w", err)
+	}
+	if h.since != db.version {
+		return followRemove(db, name) // applied
+	}
+	if db.opts.ReadOnly {
+		return errors.New("a catch-up of the follower was cut short, open it for writing")
+	}
+	if err := followWrite(db, pages, master); err != nil {
+		return err
+	}
+	return followRemove(db, name)
+}
+
+func followRemove(db *KV, name string) error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	return os.Remove(name)
+}
+
+// the pages of a commit first, then its master page, like `flushPages`
+func followWrite(db *KV, pages map[uint64][]byte, master []byte) error {
+	used := masterField(master, 0, MASTER_USED)
+	if err := extendFile(db, int(used)); err != nil {
+		return err
+	}
+	if err := db.pager.Resize(db.fileSize / BTREE_PAGE_SIZE); err != nil {
+		return err
+	}
+	for ptr, page := range pages {
+		if err := db.pager.WriteAt(page, int64(ptr * BTREE_PAGE_SIZE)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+	}
+	if err := syncFile(db); err != nil {
+		return err
+	}
+
+	db.tree.root = masterField(master, 0, MASTER_ROOT)
+	db.meta.root = masterField(master, 0, MASTER_META)
+	db.free.head = masterField(master, 0, MASTER_FREE)
+	db.pending = masterField(master, 0, MASTER_PENDING)
+	db.page.flushed = used
+	db.version = masterField(master, 0, MASTER_VERSION)
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	db.synced = db.version
+	commitDone(db)
+	return syncFile(db)
+}
@@ -0,0 +1,121 @@
+package pandora_db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SaveTo writes the last commit to a database file at `path`, which
+// is replaced atomically. This is how an in-memory database is kept.
+// The copy is encrypted with the key of the database.
+func (db *KV) SaveTo(path string) error {
+	if err := saveTo(db, path, db.crypt); err != nil {
+		return fmt.Errorf("KV.SaveTo: %w", err)
+	}
+	return nil
+}
+
+// Rekey encrypts the database at `path` under `newKey` in place of
+// `oldKey`, a nil key means no encryption. No other process may have
+// the database open.
+func Rekey(path string, oldKey []byte, newKey []byte) error {
+	var pc *pageCipher
+	if newKey != nil {
+		var err error
+		if pc, err = newPageCipher(newKey); err != nil {
+			return fmt.Errorf("Rekey: %w", err)
+		}
+	}
+	db, err := Open(path, &OpenOptions{EncryptionKey: oldKey})
+	if err != nil {
+		return fmt.Errorf("Rekey: %w", err)
+	}
+	defer db.Close()
+	if err := saveTo(db, path, pc); err != nil {
+		return fmt.Errorf("Rekey: %w", err)
+	}
+	return nil
+}
+
+func saveTo(db *KV, path string, pc *pageCipher) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.readers != nil && db.opts.ReadOnly {
+		if !readerPin(db) {
+			return errors.New("nothing committed yet")
+		}
+		defer readerUnpin(db)
+	}
+	if db.wal.fp != nil {
+		// the free list is only up to date after a checkpoint
+		if db.opts.ReadOnly {
+			return errors.New("can't checkpoint the WAL of a read-only database")
+		}
+		if err := checkpoint(db); err != nil {
+			return err
+		}
+	}
+	if !db.opts.ReadOnly {
+		// the list pages held by `SyncPeriodic` would be lost in the
+		// copy, a synced commit puts them back into the free list
+		if full, err := beginFullSync(db); err != nil {
+			return err
+		} else if full {
+			defer endFullSync(db)
+			pendingRelease(db)
+			if len(db.page.updates) > 0 || len(db.page.released) > 0 {
+				if err := flushPages(db); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	tmp := path + ".tmp"
+	var fp File
+	fp, err := OpenOSFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, db.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	if pc != nil {
+		fp = &cryptFile{File: fp, cipher: pc}
+	}
+	err = saveFile(db, fp, pc)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(path)
+}
+
+// the pages of the last commit with a fresh master page
+func saveFile(db *KV, fp File, pc *pageCipher) error {
+	master := make([]byte, BTREE_PAGE_SIZE)
+	data := masterData(db)
+	copy(master, data[:])
+	if pc != nil {
+		copy(master[KEY_CHECK_OFFSET:], pc.check[:])
+	}
+	if _, err := fp.WriteAt(master, 0); err != nil {
+		return err
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		page := db.pager.Page(ptr)
+		if pc != nil {
+			page = pageUnstamped(page)
+		}
+		_, err := fp.WriteAt(page, int64(ptr * BTREE_PAGE_SIZE))
+		if err != nil {
+			return err
+		}
+	}
+	return fp.Sync()
+}
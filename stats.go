@@ -0,0 +1,133 @@
+package pandora_db
+
+import "time"
+
+// space usage of the database
+type Stats struct {
+	FileSize int // data file size in bytes
+	MmapSize int // bytes mapped or cached by the pager
+	Cache CacheStats // of PagerPread
+	Pages uint64 // pages in use by the database, including free ones
+
+	FreePages int // pages in the free list
+	PunchedPages int // free pages whose disk space was released
+	FreeListPages int // pages holding the free list itself
+	PendingPages int // freed pages still visible to readers, and their list
+
+	// the tree and key figures are of the keys outside buckets
+	Height int
+	LeafPages int
+	InternalPages int
+	FillFactor []float64 // average page fill per tree level, root first
+
+	Keys int // expired keys not swept yet are left out, like in Get
+	KeyBytes uint64
+	ValueBytes uint64
+	// compression saves ValueBytes - StoredValueBytes, the expiry of
+	// a value is in neither
+	StoredValueBytes uint64
+	CompressedValues int
+
+	Buckets int
+}
+
+func (db *KV) Stats() Stats {
+	if db.readers != nil && db.opts.ReadOnly {
+		return readerStats(db)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		FileSize: db.fileSize,
+		MmapSize: db.pager.Size(),
+		Cache: db.pager.Cache(),
+		Pages: db.page.flushed,
+		FreePages: db.free.Total(),
+		PendingPages: len(pendingList(db)),
+	}
+
+	free, nodes := db.free.List()
+	stats.FreeListPages = len(nodes)
+	for _, ptr := range free {
+		if ptr & FREE_LIST_PUNCHED != 0 {
+			stats.PunchedPages++
+		}
+	}
+
+	statsTree(db, &stats)
+	return stats
+}
+
+// a reader process only sees the tree, the free and pending lists
+// belong to the writer and may change under it
+func readerStats(db *KV) Stats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stats := Stats{}
+	if readerPin(db) {
+		defer readerUnpin(db)
+		statsTree(db, &stats)
+	}
+	stats.FileSize = db.fileSize
+	stats.MmapSize = db.pager.Size()
+	stats.Cache = db.pager.Cache()
+	stats.Pages = db.page.flushed
+	return stats
+}
+
+func statsTree(db *KV, stats *Stats) {
+	stats.Buckets = len(bucketNames(db))
+	if db.tree.root != 0 {
+		used := []uint64{}
+		pages := []int{}
+		now := time.Now().UnixNano()
+		statsWalk(db, stats, db.tree.root, 0, &used, &pages, now)
+		for level := range used {
+			fill := float64(used[level]) / float64(pages[level] * BTREE_PAGE_SIZE)
+			stats.FillFactor = append(stats.FillFactor, fill)
+		}
+		stats.Height = len(used)
+	}
+}
+
+func statsWalk(db *KV, stats *Stats, ptr uint64, level int, used *[]uint64, pages *[]int, now int64) {
+	node := db.pageGet(ptr)
+	if level == len(*used) {
+		*used = append(*used, 0)
+		*pages = append(*pages, 0)
+	}
+	(*used)[level] += uint64(node.nbytes())
+	(*pages)[level]++
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		stats.LeafPages++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 {
+				continue // dummy key
+			}
+			stored, vflags := node.getStored(i)
+			if valueExpired(stored, vflags, now) {
+				continue
+			}
+			stats.Keys++
+			stats.KeyBytes += uint64(len(key))
+			stats.ValueBytes += uint64(valueSize(stored, vflags))
+			unexpired, _ := valueUnexpire(stored, vflags)
+			stats.StoredValueBytes += uint64(len(unexpired))
+			if vflags & BNODE_VAL_COMPRESSED != 0 {
+				stats.CompressedValues++
+			}
+		}
+	case BNODE_NODE:
+		stats.InternalPages++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			statsWalk(db, stats, node.getPtr(i), level + 1, used, pages, now)
+		}
+	default:
+		panic("invalid node type")
+	}
+}
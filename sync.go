@@ -0,0 +1,163 @@
+package pandora_db
+
+import (
+	"fmt"
+	"time"
+)
+
+// flush the data written so far according to `SyncMode`
+func syncFile(db *KV) error {
+	var err error
+	switch db.opts.SyncMode {
+	case SyncFull:
+		err = db.fp.Sync()
+	case SyncData:
+		err = db.fp.Datasync()
+	}
+	if err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// make every commit so far durable, whatever the `SyncMode`
+func syncMaster(db *KV) error {
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if db.synced == db.version {
+		return nil
+	}
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	db.synced = db.version
+	return nil
+}
+
+// a list page dropped by commit `version`
+type heldPage struct {
+	ptr uint64
+	version uint64
+}
+
+// the pages of the free and pending lists referred to by the master
+// page on disk are kept until the next sync with `SyncPeriodic`, a
+// crash goes back to these lists
+func (db *KV) pageHold(ptr uint64) bool {
+	if db.opts.SyncMode != SyncPeriodic {
+		return false
+	}
+	db.page.held = append(db.page.held, heldPage{ptr, db.version + 1})
+	return true
+}
+
+// move the held pages of the synced commits to `page.released`
+func releaseHeld(db *KV) {
+	n := 0
+	for n < len(db.page.held) && db.page.held[n].version <= db.synced {
+		db.page.released = append(db.page.released, db.page.held[n].ptr)
+		n++
+	}
+	db.page.held = db.page.held[n:]
+}
+
+func pageRelease(db *KV, ptr uint64) {
+	if !db.pageHold(ptr) {
+		db.page.released = append(db.page.released, ptr)
+	}
+}
+
+// Sync waits until every commit made so far is on disk.
+func (db *KV) Sync() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := fatalCheck(db); err != nil {
+		return fmt.Errorf("KV.Sync: %w", err)
+	}
+	if err := syncMaster(db); err != nil {
+		return fmt.Errorf("KV.Sync: %w", err)
+	}
+	return nil
+}
+
+// background syncs of `SyncPeriodic`, a failed one stops the loop and
+// fails every later write
+func syncLoop(db *KV, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		db.mu.Lock()
+		err := syncMaster(db)
+		if err != nil {
+			db.fatal = err
+		}
+		db.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func startSyncLoop(db *KV) {
+	db.syncStop = make(chan struct{})
+	db.syncDone = make(chan struct{})
+	go syncLoop(db, db.syncStop, db.syncDone)
+}
+
+func stopSyncLoop(db *KV) {
+	close(db.syncStop)
+	<-db.syncDone
+	db.syncStop = nil
+	db.syncDone = nil
+}
+
+// sync on close and put the held pages back into the free list, the
+// last commit is synced right away so that it holds nothing
+func closeSync(db *KV) error {
+	if _, err := beginFullSync(db); err != nil {
+		return err
+	}
+	pendingRelease(db)
+	if len(db.page.updates) == 0 && len(db.page.released) == 0 {
+		return nil
+	}
+	return flushPages(db)
+}
+
+// switch from `SyncPeriodic` to `SyncFull` until `endFullSync`, for
+// the commits that move or punch free pages. Nothing is held back then.
+func beginFullSync(db *KV) (bool, error) {
+	if db.opts.SyncMode != SyncPeriodic {
+		return false, nil
+	}
+	if err := syncMaster(db); err != nil {
+		return false, err
+	}
+	db.opts.SyncMode = SyncFull
+	return true, nil
+}
+
+func endFullSync(db *KV) {
+	db.opts.SyncMode = SyncPeriodic
+}
+
+// pages freed by a commit can't be reused while the master page on
+// disk, some reader or a backup may still refer to them
+func deferFree(db *KV) bool {
+	return db.opts.MultiProcess || db.opts.SyncMode == SyncPeriodic || len(db.backups) > 0
+}
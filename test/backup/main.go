@@ -0,0 +1,277 @@
+// Checks `KV.Backup` and `KV.BackupSince` with `Restore`. A backup
+// taken while writers commit has to open as a database holding one of
+// their commits whole: every commit sets the keys of a pair to the same
+// value. A full backup and the incremental ones after it have to
+// restore the contents at the last of them, with the buckets, and a
+// chain with a backup missing or out of order has to fail with
+// ErrBackupChain and leave the file alone.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+
+	"github.com/theakula/pandora_db"
+)
+
+const path = "backup_test.db"
+const copyPath = "backup_copy_test.db"
+const WRITERS = 4
+const PAIRS = 200
+
+// every key and value, those in buckets after the bucket name
+func contents(db *pandora_db.KV) (map[string]string, error) {
+	all := map[string]string{}
+	db.Scan(nil, func(key []byte, val []byte) bool {
+		all[string(key)] = string(val)
+		return true
+	})
+	names, err := db.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		b, err := db.Bucket(name)
+		if err != nil {
+			return nil, err
+		}
+		err = b.Scan(nil, func(key []byte, val []byte) bool {
+			all[name + "/" + string(key)] = string(val)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+func compare(got map[string]string, want map[string]string) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("%d keys, expected %d", len(got), len(want))
+	}
+	for key, val := range want {
+		if got[key] != val {
+			return fmt.Errorf("%q is %q, expected %q", key, got[key], val)
+		}
+	}
+	return nil
+}
+
+func open(name string) (*pandora_db.KV, error) {
+	return pandora_db.Open(name, &pandora_db.OpenOptions{})
+}
+
+// a backup taken during the commits of the writers
+func hot(db *pandora_db.KV) error {
+	stop := make(chan struct{})
+	errs := make(chan error, WRITERS)
+	wg := sync.WaitGroup{}
+	for w := 0; w < WRITERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := rand.Intn(PAIRS)
+				val := []byte(fmt.Sprintf("%d-%d", w, n))
+				err := db.Update(func(tx *pandora_db.Tx) error {
+					if err := tx.Set([]byte(fmt.Sprintf("a%d", i)), val); err != nil {
+						return err
+					}
+					return tx.Set([]byte(fmt.Sprintf("b%d", i)), val)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	copies := []*bytes.Buffer{}
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		buf := &bytes.Buffer{}
+		err = db.Backup(buf)
+		copies = append(copies, buf)
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	if err != nil {
+		return err
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	for _, buf := range copies {
+		if err := os.WriteFile(copyPath, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		other, err := open(copyPath)
+		if err != nil {
+			return err
+		}
+		all, err := contents(other)
+		other.Close()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < PAIRS; i++ {
+			a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+			if all[a] != all[b] {
+				return fmt.Errorf("%s is %q and %s is %q", a, all[a], b, all[b])
+			}
+		}
+	}
+	return nil
+}
+
+// commits that set, overwrite and delete keys, in and out of buckets
+func change(db *pandora_db.KV, round int) error {
+	if err := db.CreateBucket(fmt.Sprintf("bucket%d", round)); err != nil {
+		return err
+	}
+	return db.Update(func(tx *pandora_db.Tx) error {
+		b, err := tx.Bucket(fmt.Sprintf("bucket%d", round))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("key%d", rand.Intn(2000)))
+			val := bytes.Repeat([]byte{byte('a' + round)}, rand.Intn(2000))
+			if err := tx.Set(key, val); err != nil {
+				return err
+			}
+			if err := b.Set(key, val); err != nil {
+				return err
+			}
+			if _, err := tx.Del([]byte(fmt.Sprintf("key%d", rand.Intn(2000)))); err != nil {
+				return err
+			}
+		}
+		if round > 1 {
+			return tx.DropBucket(fmt.Sprintf("bucket%d", round - 2))
+		}
+		return nil
+	})
+}
+
+// a full backup, incremental ones after it and the contents at each
+func chain(db *pandora_db.KV) ([][]byte, []map[string]string, error) {
+	backups, states := [][]byte{}, []map[string]string{}
+	since := uint64(0)
+	for round := 0; round < 4; round++ {
+		if err := change(db, round); err != nil {
+			return nil, nil, err
+		}
+		buf := &bytes.Buffer{}
+		version, err := db.BackupSince(since, buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		all, err := contents(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		backups, states = append(backups, buf.Bytes()), append(states, all)
+		since = version
+	}
+	return backups, states, nil
+}
+
+func restore(backups ...[]byte) error {
+	readers := []io.Reader{}
+	for _, backup := range backups {
+		readers = append(readers, bytes.NewReader(backup))
+	}
+	return pandora_db.Restore(copyPath, readers...)
+}
+
+func restored() (map[string]string, error) {
+	other, err := open(copyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer other.Close()
+	return contents(other)
+}
+
+func incremental(db *pandora_db.KV) error {
+	backups, states, err := chain(db)
+	if err != nil {
+		return err
+	}
+	for n := 1; n <= len(backups); n++ {
+		if err := restore(backups[:n]...); err != nil {
+			return fmt.Errorf("restoring %d backups: %w", n, err)
+		}
+		all, err := restored()
+		if err != nil {
+			return err
+		}
+		if err := compare(all, states[n - 1]); err != nil {
+			return fmt.Errorf("restoring %d backups: %w", n, err)
+		}
+	}
+
+	// the file of the whole chain stays when a restore fails
+	for _, bad := range [][][]byte{
+		{backups[0], backups[2]},
+		{backups[1], backups[2]},
+		{backups[0], backups[2], backups[1]},
+	} {
+		if err := restore(bad...); !errors.Is(err, pandora_db.ErrBackupChain) {
+			return fmt.Errorf("broken chain: %v, expected ErrBackupChain", err)
+		}
+		all, err := restored()
+		if err != nil {
+			return err
+		}
+		if err := compare(all, states[len(states) - 1]); err != nil {
+			return fmt.Errorf("after a broken chain: %w", err)
+		}
+	}
+	return nil
+}
+
+func run() error {
+	db, err := pandora_db.Open(path, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, test := range []struct {
+		name string
+		fn func(*pandora_db.KV) error
+	}{{"hot", hot}, {"incremental", incremental}} {
+		if err := test.fn(db); err != nil {
+			return fmt.Errorf("%s: %w", test.name, err)
+		}
+		fmt.Println(test.name, "ok")
+	}
+	return nil
+}
+
+func main() {
+	os.Remove(path)
+	os.Remove(copyPath)
+	err := run()
+	os.Remove(path)
+	os.Remove(copyPath)
+	if err != nil {
+		fmt.Println("failed: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,276 @@
+//go:build faults
+
+// Crash recovery suite. Every round runs a random workload on files
+// opened through pandora_db.Faults, makes one call crash or fail with
+// ENOSPC, then reopens the database and checks that it holds either
+// the state before the failed operation or the state after it.
+// Run with `go run -tags faults ./crash`.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/theakula/pandora_db"
+)
+
+const path = "crash_test.db"
+const NKEYS = 300
+const NOPS = 300
+
+type state map[string]string
+
+func (s state) copy() state {
+	c := state{}
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+var key16 = []byte("0123456789abcdef")
+
+type config struct {
+	name string
+	opts pandora_db.OpenOptions
+	ttl bool // set half of the values with a TTL that outlives the round
+	tx bool // change every key in a bucket too, in the same transaction
+	changelog bool // the logged changes add up to the state
+}
+
+var configs = []config{
+	{"SyncFull", pandora_db.OpenOptions{SyncMode: pandora_db.SyncFull}, false, false, false},
+	{"SyncData", pandora_db.OpenOptions{SyncMode: pandora_db.SyncData}, false, false, false},
+	{"WAL", pandora_db.OpenOptions{WAL: true, WALCheckpointSize: 16 << 10}, false, false, false},
+	{"MultiProcess", pandora_db.OpenOptions{MultiProcess: true}, false, false, false},
+	{"PagerPread", pandora_db.OpenOptions{Pager: pandora_db.PagerPread, PageCacheSize: 16 << 10}, false, false, false},
+	{"PagerMemory", pandora_db.OpenOptions{Pager: pandora_db.PagerMemory}, false, false, false},
+	{"Encrypted", pandora_db.OpenOptions{EncryptionKey: key16}, false, false, false},
+	{"CompressedWAL", pandora_db.OpenOptions{Compression: "flate", WAL: true, WALCheckpointSize: 16 << 10}, false, false, false},
+	{"EncryptedWAL", pandora_db.OpenOptions{EncryptionKey: key16, WAL: true, WALCheckpointSize: 16 << 10}, false, false, false},
+	{"TTL", pandora_db.OpenOptions{SyncMode: pandora_db.SyncFull}, true, false, false},
+	{"TTLWAL", pandora_db.OpenOptions{WAL: true, WALCheckpointSize: 16 << 10}, true, false, false},
+	{"Tx", pandora_db.OpenOptions{SyncMode: pandora_db.SyncFull}, false, true, false},
+	{"TxWAL", pandora_db.OpenOptions{WAL: true, WALCheckpointSize: 16 << 10}, false, true, false},
+	{"ChangeLog", pandora_db.OpenOptions{ChangeLog: true}, false, false, true},
+	{"ChangeLogWAL", pandora_db.OpenOptions{ChangeLog: true, WAL: true, WALCheckpointSize: 16 << 10}, false, false, true},
+}
+
+// the bucket of the Tx configs, created by the first change
+func bucket(tx *pandora_db.Tx) *pandora_db.Bucket {
+	b, err := tx.Bucket("copy")
+	if err != nil {
+		tx.CreateBucket("copy")
+		b, _ = tx.Bucket("copy")
+	}
+	return b
+}
+
+func key(i int) string {
+	return fmt.Sprintf("key%04d", i)
+}
+
+// run the workload of `seed` until an operation fails, returns the
+// states before and after the failed operation
+func workload(seed int64, conf config, faults *pandora_db.Faults) (state, state, *pandora_db.KV, error) {
+	rng := rand.New(rand.NewSource(seed))
+	opts := conf.opts
+	opts.CreateIfMissing = true
+	opts.InitialMmapSize = 16 << 10
+	opts.OpenFile = faults.OpenFile
+
+	done := state{}
+	db, err := pandora_db.Open(path, &opts)
+	if err != nil {
+		return done, done, nil, err
+	}
+
+	for i := 0; i < NOPS; i++ {
+		next := done.copy()
+		k := key(rng.Intn(NKEYS))
+		switch n := rng.Intn(100); {
+		case n < 70:
+			v := fmt.Sprintf("%s:%d:%s", k, i, strings.Repeat("v", rng.Intn(500)))
+			next[k] = v
+			if conf.tx {
+				err = db.Update(func(tx *pandora_db.Tx) error {
+					tx.Set([]byte(k), []byte(v))
+					return bucket(tx).Set([]byte(k), []byte(v))
+				})
+			} else if conf.ttl && rng.Intn(2) == 0 {
+				err = db.SetWithTTL([]byte(k), []byte(v), time.Hour)
+			} else {
+				err = db.Set([]byte(k), []byte(v))
+			}
+		case n < 95:
+			delete(next, k)
+			if conf.tx {
+				err = db.Update(func(tx *pandora_db.Tx) error {
+					tx.Del([]byte(k))
+					_, err := bucket(tx).Del([]byte(k))
+					return err
+				})
+			} else {
+				_, err = db.Del([]byte(k))
+			}
+		case n < 98:
+			err = db.Compact()
+		default:
+			err = db.PunchHoles()
+		}
+		if err != nil {
+			return done, next, db, err
+		}
+		done = next
+	}
+	return done, done, db, nil
+}
+
+func check(db *pandora_db.KV, want state, conf config) bool {
+	for i := 0; i < NKEYS; i++ {
+		val, ok := db.Get([]byte(key(i)))
+		if v, in := want[key(i)]; ok != in || string(val) != v {
+			return false
+		}
+	}
+	if conf.tx {
+		// the bucket has the same keys, "extra" aside
+		n := 0
+		b, err := db.Bucket("copy")
+		if err == nil {
+			b.Scan(nil, func(k []byte, v []byte) bool {
+				n++
+				return want[string(k)] == string(v)
+			})
+		}
+		if _, in := want["extra"]; n != len(want) && !(in && n == len(want) - 1) {
+			return false
+		}
+	}
+	if conf.changelog {
+		logged := state{}
+		for from := uint64(0); ; {
+			changes, err := db.Changes(from)
+			if err != nil {
+				return false
+			}
+			for _, change := range changes {
+				if change.Op == pandora_db.ChangeSet {
+					logged[string(change.Key)] = string(change.New)
+				} else {
+					delete(logged, string(change.Key))
+				}
+				from = change.Seq + 1
+			}
+			if len(changes) < pandora_db.CHANGES_BATCH {
+				break
+			}
+		}
+		if len(logged) != len(want) {
+			return false
+		}
+		for k, v := range want {
+			if logged[k] != v {
+				return false
+			}
+		}
+	}
+	return db.Stats().Keys == len(want)
+}
+
+func reopen(conf config) (*pandora_db.KV, error) {
+	return pandora_db.Open(path, &pandora_db.OpenOptions{EncryptionKey: conf.opts.EncryptionKey})
+}
+
+func round(seed int64) (err error) {
+	rng := rand.New(rand.NewSource(seed))
+	conf := configs[rng.Intn(len(configs))]
+	// a corrupted file may fail an assertion
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", conf.name, r)
+		}
+	}()
+	defer os.Remove(path)
+	defer os.Remove(path + "-wal")
+	defer os.Remove(path + "-lock")
+
+	// a clean run to count the calls that can fail
+	dry := &pandora_db.Faults{}
+	var db *pandora_db.KV
+	_, _, db, err = workload(seed, conf, dry)
+	if err != nil {
+		return fmt.Errorf("%s: clean run: %w", conf.name, err)
+	}
+	db.Close()
+	os.Remove(path)
+	os.Remove(path + "-wal")
+
+	faults := &pandora_db.Faults{}
+	nth := 1 + rng.Intn(dry.Calls())
+	enospc := rng.Intn(3) == 0
+	if enospc {
+		faults.FailAt = nth
+	} else {
+		faults.CrashAt = nth
+	}
+	var before, after state
+	before, after, db, err = workload(seed, conf, faults)
+	if err == nil {
+		// the call came after the last operation, in Close
+		after = before
+	}
+
+	extra := "extra"
+	if enospc && db != nil && err != nil {
+		// the failed operation must not break the ones after it
+		if err := db.Set([]byte(extra), []byte(extra)); err != nil {
+			return fmt.Errorf("%s: set after ENOSPC at call %d: %w", conf.name, nth, err)
+		}
+		before[extra] = extra
+		after[extra] = extra
+	}
+	if db != nil {
+		db.Close()
+	}
+	if !enospc {
+		if err := faults.Crash(rng); err != nil {
+			return err
+		}
+	}
+
+	db, err = reopen(conf)
+	if err != nil {
+		return fmt.Errorf("%s: reopen after call %d: %w", conf.name, nth, err)
+	}
+	defer db.Close()
+	if !check(db, before, conf) && !check(db, after, conf) {
+		return fmt.Errorf(
+			"%s: after call %d (enospc %v) the state is neither the old nor the new one",
+			conf.name, nth, enospc,
+		)
+	}
+	return nil
+}
+
+func main() {
+	rounds := flag.Int("rounds", 200, "number of crashes")
+	seed := flag.Int64("seed", 1, "seed of the first round")
+	flag.Parse()
+
+	failed := 0
+	for i := 0; i < *rounds; i++ {
+		if err := round(*seed + int64(i)); err != nil {
+			fmt.Printf("seed %d: %v\n", *seed + int64(i), err)
+			failed++
+		}
+	}
+	fmt.Printf("%d rounds, %d failed\n", *rounds, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
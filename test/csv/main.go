@@ -0,0 +1,188 @@
+// Checks the import-csv and export-csv commands of cmd/pandora, built
+// into a temporary directory. A CSV file has to come back the same
+// after an import and an export, with JSON values of several columns
+// and with raw values in a bucket. Malformed rows have to be reported
+// with their line and skipped, the rows around them imported.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/theakula/pandora_db"
+)
+
+const path = "csv_test.db"
+
+var bin string
+
+// run the command with `args`, its standard error is returned
+func pandora(args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("pandora %s: %w: %s", args[0], err, stderr.String())
+	}
+	return stderr.String(), err
+}
+
+func parse(data string, comma rune) ([][]string, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.Comma = comma
+	return r.ReadAll()
+}
+
+// import `in` and export it again with the same flags, the rows of
+// `in` have to be in key order
+func roundTrip(in string, comma rune, flags ...string) error {
+	os.Remove(path)
+	src, out := filepath.Join(filepath.Dir(bin), "in.csv"), filepath.Join(filepath.Dir(bin), "out.csv")
+	if err := os.WriteFile(src, []byte(in), 0644); err != nil {
+		return err
+	}
+	want, err := parse(in, comma)
+	if err != nil {
+		return err
+	}
+	stderr, err := pandora(append(append([]string{"import-csv"}, flags...), "-batch", "2", path, src)...)
+	if err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("imported %d rows, skipped 0", len(want) - 1)
+	if !strings.Contains(stderr, summary) {
+		return fmt.Errorf("import: %q, expected %q", stderr, summary)
+	}
+	if _, err := pandora(append(append([]string{"export-csv"}, flags...), path, out)...); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	got, err := parse(string(data), comma)
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		return fmt.Errorf("exported %q, expected %q", got, want)
+	}
+	return nil
+}
+
+func clean() error {
+	// quoted commas, quotes and newlines, and two key columns
+	in := "id,region,name,qty\n" +
+		"1,eu,\"Smith, Ann\",3\n" +
+		"1,us,\"say \"\"hi\"\"\",\n" +
+		"2,eu,\"two\nlines\",7\n" +
+		"3,asia,ünïcode,0\n" +
+		"4,eu,,12\n"
+	if err := roundTrip(in, ',', "-key-columns", "id,region", "-key-sep", "/"); err != nil {
+		return fmt.Errorf("json: %w", err)
+	}
+	db, err := pandora_db.Open(path, &pandora_db.OpenOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	val, _ := db.Get([]byte("1/eu"))
+	db.Close()
+	if string(val) != `{"name":"Smith, Ann","qty":"3"}` {
+		return fmt.Errorf("json: the value of %q is %q", "1/eu", val)
+	}
+
+	in = "k;v\n" + "a;1\n" + "b;x,y\n" + "c;\n" + "d;\"semi;colon\"\n"
+	flags := []string{"-comma", ";", "-value", "raw", "-key-columns", "k", "-value-column", "v", "-bucket", "b"}
+	if err := roundTrip(in, ';', flags...); err != nil {
+		return fmt.Errorf("raw: %w", err)
+	}
+	return nil
+}
+
+func malformed() error {
+	os.Remove(path)
+	in := "k,v\n" +
+		"a,1\n" +
+		"b,1,extra\n" + // line 3, too many fields
+		"c,2\n" +
+		"d\n" + // line 5, too few fields
+		"e,x\"y\n" + // line 6, a bare quote
+		",3\n" + // line 7, an empty key
+		"f," + strings.Repeat("v", pandora_db.BTREE_MAX_VAL_SIZE + 1) + "\n" + // line 8, too long
+		"g,\"quoted\nvalue\"\n" +
+		"h,\"x\"y\"\n" + // line 11, a quote inside a quoted field
+		"i,4\n"
+	src := filepath.Join(filepath.Dir(bin), "in.csv")
+	if err := os.WriteFile(src, []byte(in), 0644); err != nil {
+		return err
+	}
+	stderr, err := pandora("import-csv", "-value", "raw", "-batch", "2", path, src)
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, m := range regexp.MustCompile(`pandora: line (\d+):`).FindAllStringSubmatch(stderr, -1) {
+		lines = append(lines, m[1])
+	}
+	if got := strings.Join(lines, ","); got != "3,5,6,7,8,11" {
+		return fmt.Errorf("reported lines %s, expected 3,5,6,7,8,11:\n%s", got, stderr)
+	}
+	if !strings.Contains(stderr, "imported 4 rows, skipped 6") {
+		return fmt.Errorf("bad summary:\n%s", stderr)
+	}
+
+	db, err := pandora_db.Open(path, &pandora_db.OpenOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	found := []string{}
+	db.Scan(nil, func(key []byte, val []byte) bool {
+		found = append(found, string(key) + "=" + string(val))
+		return true
+	})
+	if got := strings.Join(found, " "); got != "a=1 c=2 g=quoted\nvalue i=4" {
+		return fmt.Errorf("imported %q", got)
+	}
+	return nil
+}
+
+func run() error {
+	dir, err := os.MkdirTemp("", "pandora")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	bin = filepath.Join(dir, "pandora")
+	build := exec.Command("go", "build", "-o", bin, "github.com/theakula/pandora_db/cmd/pandora")
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("go build: %w: %s", err, out)
+	}
+	for _, test := range []struct {
+		name string
+		fn func() error
+	}{{"clean", clean}, {"malformed", malformed}} {
+		if err := test.fn(); err != nil {
+			return fmt.Errorf("%s: %w", test.name, err)
+		}
+		fmt.Println(test.name, "ok")
+	}
+	return nil
+}
+
+func main() {
+	os.Remove(path)
+	err := run()
+	os.Remove(path)
+	if err != nil {
+		fmt.Println("failed: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,234 @@
+// Checks `KV.Dump` and `KV.Load`. A database with empty values, an
+// empty bucket, keys with a TTL and compressed values has to load into
+// another one, compressed or not, that dumps the same records, without
+// the keys that expired in between. A malformed record has to stop the
+// load at its line, reported in the error, with the records before it
+// set.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/theakula/pandora_db"
+)
+
+const path = "dump_test.db"
+const copyPath = "dump_copy_test.db"
+const SHORT_TTL = 200 * time.Millisecond
+
+type record struct {
+	Bucket []byte `json:"bucket"`
+	Key []byte `json:"key"`
+	Value []byte `json:"value"`
+	Expires int64 `json:"expires"`
+}
+
+func open(name string, compression string) (*pandora_db.KV, error) {
+	os.Remove(name)
+	return pandora_db.Open(name, &pandora_db.OpenOptions{
+		CreateIfMissing: true, Compression: compression,
+	})
+}
+
+// the records of a dump after the header
+func records(dump []byte) ([]record, error) {
+	recs := []record{}
+	in := bufio.NewScanner(bytes.NewReader(dump))
+	in.Buffer(nil, 1 << 20)
+	for n := 0; in.Scan(); n++ {
+		if n == 0 {
+			continue
+		}
+		rec := record{}
+		if err := json.Unmarshal(in.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, in.Err()
+}
+
+func fill(db *pandora_db.KV) error {
+	big := bytes.Repeat([]byte("compressible "), 200)
+	if err := db.Set([]byte("empty"), []byte{}); err != nil {
+		return err
+	}
+	if err := db.Set([]byte("big"), big); err != nil {
+		return err
+	}
+	if err := db.SetCompressed([]byte("big2"), big[:1000], "flate"); err != nil {
+		return err
+	}
+	if err := db.SetWithTTL([]byte("ttl"), []byte("later"), time.Hour); err != nil {
+		return err
+	}
+	if err := db.SetWithTTL([]byte("short"), []byte("soon"), SHORT_TTL); err != nil {
+		return err
+	}
+	if err := db.CreateBucket("empty bucket"); err != nil {
+		return err
+	}
+	if err := db.CreateBucket("b"); err != nil {
+		return err
+	}
+	b, err := db.Bucket("b")
+	if err != nil {
+		return err
+	}
+	if err := b.Set([]byte("empty"), nil); err != nil {
+		return err
+	}
+	return b.Set([]byte("big"), big)
+}
+
+func compare(got []record, want []record) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("%d records, expected %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if !bytes.Equal(g.Bucket, w.Bucket) || !bytes.Equal(g.Key, w.Key) ||
+			!bytes.Equal(g.Value, w.Value) || g.Expires != w.Expires {
+			return fmt.Errorf("record %d is %q/%q, expected %q/%q", i, g.Bucket, g.Key, w.Bucket, w.Key)
+		}
+	}
+	return nil
+}
+
+// dump a database, load it into a compressed and an uncompressed one
+// once the short TTL passed, and dump those
+func roundTrip() error {
+	db, err := open(path, "flate")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := fill(db); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err := db.Dump(buf); err != nil {
+		return err
+	}
+	dumped := append([]byte{}, buf.Bytes()...)
+	recs, err := records(dumped)
+	if err != nil {
+		return err
+	}
+
+	want := []record{}
+	for _, rec := range recs {
+		if rec.Bucket == nil && string(rec.Key) == "short" {
+			if rec.Expires == 0 {
+				return fmt.Errorf("%q dumped without its expiry", rec.Key)
+			}
+			continue
+		}
+		if rec.Bucket == nil && string(rec.Key) == "ttl" && rec.Expires == 0 {
+			return fmt.Errorf("%q dumped without its expiry", rec.Key)
+		}
+		want = append(want, rec)
+	}
+	if len(want) != len(recs) - 1 {
+		return fmt.Errorf("%q is missing from the dump", "short")
+	}
+	time.Sleep(2 * SHORT_TTL)
+
+	for _, compression := range []string{"flate", ""} {
+		other, err := open(copyPath, compression)
+		if err != nil {
+			return err
+		}
+		err = other.Load(bytes.NewReader(dumped))
+		if err == nil {
+			buf.Reset()
+			err = other.Dump(buf)
+		}
+		if err == nil {
+			recs, err = records(buf.Bytes())
+		}
+		if err == nil {
+			err = compare(recs, want)
+		}
+		stats := other.Stats()
+		val, ok := other.Get([]byte("empty"))
+		names, _ := other.ListBuckets()
+		other.Close()
+		if err != nil {
+			return fmt.Errorf("compression %q: %w", compression, err)
+		}
+		if !ok || len(val) != 0 {
+			return fmt.Errorf("compression %q: the empty value is %q, found %v", compression, val, ok)
+		}
+		if strings.Join(names, ",") != "b,empty bucket" {
+			return fmt.Errorf("compression %q: buckets %q", compression, names)
+		}
+		if compressed := stats.StoredValueBytes < stats.ValueBytes; compressed != (compression != "") {
+			return fmt.Errorf("compression %q: %d bytes stored for %d", compression, stats.StoredValueBytes, stats.ValueBytes)
+		}
+	}
+	return nil
+}
+
+// a bad record at `line` of the dump made of `lines`
+func malformed(lines []string, line int) error {
+	db, err := open(copyPath, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Load(strings.NewReader(strings.Join(lines, "\n")))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("line %d:", line)) {
+		return fmt.Errorf("expected an error at line %d, got %v", line, err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, ok := db.Get([]byte(key)); !ok {
+			return fmt.Errorf("%q before the bad record is missing", key)
+		}
+	}
+	if _, ok := db.Get([]byte("c")); ok {
+		return fmt.Errorf("%q after the bad record was loaded", "c")
+	}
+	return nil
+}
+
+func badRecords() error {
+	header := `{"format":"pandora-dump","version":1}`
+	// the keys are "a", "b" and "c" in base64
+	for _, test := range []struct {
+		lines []string
+		line int
+	}{
+		{[]string{header, `{"key":"YQ=="}`, `{"key":"Yg==","value":""}`, `{"key":`, `{"key":"Yw=="}`}, 4},
+		{[]string{header, `{"key":"YQ=="}`, ``, `{"key":"Yg=="}`, `{"key":"not base64!"}`, `{"key":"Yw=="}`}, 5},
+		{[]string{header, `{"key":"YQ==","value":"YQ=="}`, `{"key":"Yg=="}`, ``, `{"value":"YQ=="}`, `{"key":"Yw=="}`}, 5},
+	} {
+		if err := malformed(test.lines, test.line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	err := roundTrip()
+	if err == nil {
+		fmt.Println("round trip ok")
+		err = badRecords()
+	}
+	if err == nil {
+		fmt.Println("bad records ok")
+	}
+	os.Remove(path)
+	os.Remove(copyPath)
+	if err != nil {
+		fmt.Println("failed: ", err)
+		os.Exit(1)
+	}
+}
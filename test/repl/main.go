@@ -0,0 +1,255 @@
+//go:build faults
+
+// Replicates a writer process to a follower in this one over
+// localhost. The writer is killed and started again a few times, each
+// commit adds the next key, so the follower must always hold a prefix
+// of the sequence and catch up with all of it in the end. The follower
+// also crashes in the middle of catching up, through
+// pandora_db.Faults, and has to open with a prefix again. Once written
+// on by itself it has to be refused. Run with
+// `go run -tags faults ./repl`.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/theakula/pandora_db"
+)
+
+const primaryPath = "repl_primary.db"
+const followerPath = "repl_follower.db"
+const ROUNDS = 4
+const CRASHES = 4
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+// serve followers on `addr` and write keys until killed, printing the
+// number of keys after every commit. With `write` false only print it
+// once.
+func primary(addr string, write bool) {
+	db, err := pandora_db.Open(primaryPath, &pandora_db.OpenOptions{CreateIfMissing: true})
+	if err != nil {
+		fmt.Println("failed to open db: ", err)
+		os.Exit(1)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("failed to listen: ", err)
+		os.Exit(1)
+	}
+	go db.ServeReplicas(ln)
+
+	out := bufio.NewWriter(os.Stdout)
+	n := db.Stats().Keys
+	fmt.Fprintln(out, n)
+	out.Flush()
+	for write {
+		if err := db.Set(key(n), key(n)); err != nil {
+			fmt.Println("failed to set: ", err)
+			os.Exit(1)
+		}
+		n++
+		fmt.Fprintln(out, n)
+		out.Flush()
+	}
+	select {}
+}
+
+// run the primary for a while and return the last number it printed
+func start(addr string, write bool, d time.Duration) (int, error) {
+	cmd := exec.Command(os.Args[0], "primary", addr, strconv.FormatBool(write))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	time.AfterFunc(d, func() { _ = cmd.Process.Kill() })
+
+	done := 0
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		n, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			return 0, fmt.Errorf("primary: %s", scanner.Text())
+		}
+		done = n
+	}
+	_ = cmd.Wait()
+	return done, nil
+}
+
+// the keys of the follower, which must be a prefix of the sequence
+func prefix(db *pandora_db.KV) (int, error) {
+	found := 0
+	for {
+		if _, ok := db.Get(key(found)); !ok {
+			break
+		}
+		found++
+	}
+	if keys := db.Stats().Keys; keys != found {
+		return 0, fmt.Errorf("%d keys are not a prefix of the %d commits", keys, found)
+	}
+	return found, nil
+}
+
+// crash the follower after `crashAt` calls to its files while it
+// catches up with a primary that wrote on without it
+func crash(addr string, crashAt int, rng *rand.Rand) error {
+	done, err := start(addr, true, time.Second)
+	if err != nil {
+		return err
+	}
+	faults := &pandora_db.Faults{CrashAt: crashAt}
+	db, err := pandora_db.Open(followerPath, &pandora_db.OpenOptions{
+		Primary: addr, OpenFile: faults.OpenFile,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := start(addr, false, 3 * time.Second); err != nil {
+		return err
+	}
+	db.Close()
+	crashed := faults.Crashed()
+	if crashed {
+		if err := faults.Crash(rng); err != nil {
+			return err
+		}
+	}
+
+	db, err = pandora_db.Open(followerPath, &pandora_db.OpenOptions{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	found, err := prefix(db)
+	if err != nil {
+		return err
+	}
+	if !crashed && found != done {
+		return fmt.Errorf("the follower has %d keys, the primary %d", found, done)
+	}
+	fmt.Printf("crash after %d calls: %d commits, the follower has %d\n", crashAt, done, found)
+	return nil
+}
+
+func run() error {
+	// a free port, the primary listens on the same one every time
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	opts := &pandora_db.OpenOptions{CreateIfMissing: true, Primary: addr}
+	db, err := pandora_db.Open(followerPath, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { db.Close() }()
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for round := 1; round <= ROUNDS; round++ {
+		done, err := start(addr, true, 2 * time.Second)
+		if err != nil {
+			return err
+		}
+		found, err := prefix(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("round %d: %d commits, the follower has %d\n", round, done, found)
+
+		// the follower catches up from its last commit after a restart
+		if round % 2 == 0 {
+			db.Close()
+			if db, err = pandora_db.Open(followerPath, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.Close()
+	for i := 0; i < CRASHES; i++ {
+		if err := crash(addr, 1 + rng.Intn(60), rng); err != nil {
+			return err
+		}
+	}
+	if db, err = pandora_db.Open(followerPath, opts); err != nil {
+		return err
+	}
+
+	// let the primary serve without writing until the follower has
+	// every key
+	wait := 5 * time.Second
+	done, err := start(addr, false, wait)
+	if err != nil {
+		return err
+	}
+	found, err := prefix(db)
+	if err != nil {
+		return err
+	}
+	if found != done {
+		return fmt.Errorf("the follower has %d keys after %v, the primary %d", found, wait, done)
+	}
+	fmt.Printf("caught up with %d keys\n", found)
+
+	// written on without the primary, the follower has a commit the
+	// primary doesn't and is refused
+	db.Close()
+	if db, err = pandora_db.Open(followerPath, &pandora_db.OpenOptions{}); err != nil {
+		return err
+	}
+	if err := db.Set([]byte("diverged"), nil); err != nil {
+		return err
+	}
+	keys := db.Stats().Keys
+	db.Close()
+	if _, err := start(addr, true, time.Second); err != nil {
+		return err
+	}
+	if db, err = pandora_db.Open(followerPath, opts); err != nil {
+		return err
+	}
+	if _, err := start(addr, false, 3 * time.Second); err != nil {
+		return err
+	}
+	if _, ok := db.Get([]byte("diverged")); !ok || db.Stats().Keys != keys {
+		return fmt.Errorf("a follower with a commit of its own took those of the primary")
+	}
+	fmt.Println("refused after diverging")
+	return nil
+}
+
+func main() {
+	if len(os.Args) == 4 && os.Args[1] == "primary" {
+		write, _ := strconv.ParseBool(os.Args[3])
+		primary(os.Args[2], write)
+		return
+	}
+
+	os.Remove(primaryPath)
+	os.Remove(followerPath)
+	err := run()
+	os.Remove(primaryPath)
+	os.Remove(followerPath)
+	os.Remove(followerPath + "-catchup")
+	if err != nil {
+		fmt.Println("failed: ", err)
+		os.Exit(1)
+	}
+}
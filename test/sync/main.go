@@ -0,0 +1,154 @@
+// Kills a writer process in the middle of its commits in every
+// SyncMode and in WAL mode and checks what survives. Each commit adds
+// the next key, so the keys left after the crash must be a prefix of
+// the sequence.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/theakula/pandora_db"
+)
+
+const path = "sync_test.db"
+
+var modes = []struct {
+	name string
+	mode pandora_db.SyncMode
+	wal bool
+}{
+	{"SyncFull", pandora_db.SyncFull, false},
+	{"SyncData", pandora_db.SyncData, false},
+	{"SyncPeriodic", pandora_db.SyncPeriodic, false},
+	{"SyncNone", pandora_db.SyncNone, false},
+	{"WAL", pandora_db.SyncFull, true},
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+// write keys until killed, printing the number of every commit that
+// returned, and the number of the last synced one as "sync N"
+func writer(mode pandora_db.SyncMode, wal bool) {
+	db, err := pandora_db.Open(path, &pandora_db.OpenOptions{
+		CreateIfMissing: true,
+		SyncMode: mode,
+		SyncInterval: 20 * time.Millisecond,
+		WAL: wal,
+		WALCheckpointSize: 64 << 10,
+	})
+	if err != nil {
+		fmt.Println("failed to open db: ", err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for i := 0; ; i++ {
+		if err := db.Set(key(i), key(i)); err != nil {
+			fmt.Println("failed to set: ", err)
+			os.Exit(1)
+		}
+		if i % 100 == 99 {
+			if err := db.Sync(); err != nil {
+				fmt.Println("failed to sync: ", err)
+				os.Exit(1)
+			}
+			fmt.Fprintln(out, "sync", i + 1)
+		}
+		fmt.Fprintln(out, i + 1)
+		out.Flush()
+	}
+}
+
+// kill the writer and return the number of commits it reported
+func crash(mode pandora_db.SyncMode, wal bool) (int, int, error) {
+	cmd := exec.Command(os.Args[0], "writer", strconv.Itoa(int(mode)), strconv.FormatBool(wal))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, 0, err
+	}
+	time.AfterFunc(500 * time.Millisecond, func() { _ = cmd.Process.Kill() })
+
+	done, synced := 0, 0
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var n int
+		if _, err := fmt.Sscanf(scanner.Text(), "sync %d", &n); err == nil {
+			synced = n
+		} else if n, err = strconv.Atoi(scanner.Text()); err == nil {
+			done = n
+		} else {
+			return 0, 0, fmt.Errorf("writer: %s", scanner.Text())
+		}
+	}
+	_ = cmd.Wait()
+	return done, synced, nil
+}
+
+func check(name string, mode pandora_db.SyncMode, wal bool) error {
+	os.Remove(path)
+	os.Remove(path + "-wal")
+	done, synced, err := crash(mode, wal)
+	if err != nil {
+		return err
+	}
+
+	db, err := pandora_db.Open(path, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	found := 0
+	for {
+		if _, ok := db.Get(key(found)); !ok {
+			break
+		}
+		found++
+	}
+	stats := db.Stats()
+	if stats.Keys != found {
+		return fmt.Errorf("%d keys are not a prefix of the %d commits", stats.Keys, found)
+	}
+	if found < synced {
+		return fmt.Errorf("%d keys, but %d were synced", found, synced)
+	}
+	// only SyncPeriodic may lose commits when the OS keeps running
+	if mode != pandora_db.SyncPeriodic && found < done {
+		return fmt.Errorf("%d keys, but %d commits returned", found, done)
+	}
+
+	fmt.Printf("%s: %d commits, %d synced, %d survived\n", name, done, synced, found)
+	return nil
+}
+
+func main() {
+	if len(os.Args) == 4 && os.Args[1] == "writer" {
+		mode, _ := strconv.Atoi(os.Args[2])
+		wal, _ := strconv.ParseBool(os.Args[3])
+		writer(pandora_db.SyncMode(mode), wal)
+		return
+	}
+
+	failed := false
+	for _, m := range modes {
+		if err := check(m.name, m.mode, m.wal); err != nil {
+			fmt.Println(m.name, "failed: ", err)
+			failed = true
+		}
+	}
+	os.Remove(path)
+	os.Remove(path + "-wal")
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,216 @@
+// Checks what `KV.Watch` sends: the changes of every commit in order,
+// filtered by bucket and prefix, with their old and new values, and
+// that a receiver too slow to keep up, a done context and closing the
+// database each close the channel and leave no goroutine behind.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/theakula/pandora_db"
+)
+
+const path = "watch_test.db"
+const BUFFER = 16
+
+// the changes sent so far, without waiting for more
+func drain(ch <-chan pandora_db.Change) ([]pandora_db.Change, bool) {
+	changes := []pandora_db.Change{}
+	for {
+		select {
+		case change, ok := <-ch:
+			if !ok {
+				return changes, false
+			}
+			changes = append(changes, change)
+		default:
+			return changes, true
+		}
+	}
+}
+
+// prefix filtering and the order and content of the changes
+func order(db *pandora_db.KV) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := db.Watch(ctx, nil)
+	as := db.Watch(ctx, []byte("a"))
+	b, err := db.Bucket("b")
+	if err != nil {
+		return err
+	}
+	inBucket := b.Watch(ctx, nil)
+
+	for i := 0; i < BUFFER / 2; i++ {
+		key := []byte(fmt.Sprintf("%c%d", "ab"[i % 2], i))
+		if err := db.Set(key, []byte("v1")); err != nil {
+			return err
+		}
+		if err := b.Set(key, []byte("v2")); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Del([]byte("a0")); err != nil {
+		return err
+	}
+	if err := db.Set([]byte("a2"), []byte("v3")); err != nil {
+		return err
+	}
+
+	got, open := drain(all)
+	if !open || len(got) != BUFFER / 2 + 2 {
+		return fmt.Errorf("watching everything: %d changes, open %v", len(got), open)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Commit <= got[i - 1].Commit {
+			return fmt.Errorf("change %d is from commit %d after %d", i, got[i].Commit, got[i - 1].Commit)
+		}
+	}
+	del, set := got[len(got) - 2], got[len(got) - 1]
+	if del.Op != pandora_db.ChangeDel || string(del.Old) != "v1" || del.New != nil {
+		return fmt.Errorf("bad delete %+v", del)
+	}
+	if set.Op != pandora_db.ChangeSet || string(set.Old) != "v1" || string(set.New) != "v3" {
+		return fmt.Errorf("bad overwrite %+v", set)
+	}
+	if first := got[0]; first.Old != nil || string(first.New) != "v1" {
+		return fmt.Errorf("bad first set %+v", first)
+	}
+
+	everything := got
+	got, _ = drain(as)
+	if len(got) != BUFFER / 4 + 2 {
+		return fmt.Errorf("watching \"a\": %d changes", len(got))
+	}
+	for _, change := range got {
+		if change.Key[0] != 'a' || change.Bucket != "" {
+			return fmt.Errorf("watching \"a\": got %q in bucket %q", change.Key, change.Bucket)
+		}
+	}
+	// the receivers don't share the slices
+	got[0].Key[0] = 'x'
+	got[0].New[0] = 'x'
+	if !bytes.Equal(everything[0].Key, []byte("a0")) || !bytes.Equal(everything[0].New, []byte("v1")) {
+		return fmt.Errorf("a change shared with another receiver")
+	}
+
+	got, _ = drain(inBucket)
+	if len(got) != BUFFER / 2 {
+		return fmt.Errorf("watching the bucket: %d changes", len(got))
+	}
+	for _, change := range got {
+		if change.Bucket != "b" || string(change.New) != "v2" {
+			return fmt.Errorf("watching the bucket: got %+v", change)
+		}
+	}
+	return nil
+}
+
+// a receiver that doesn't read loses its channel after BUFFER changes,
+// the others keep theirs
+func slow(db *pandora_db.KV) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lazy := db.Watch(ctx, []byte("s"))
+	busy := db.Watch(ctx, []byte("s"))
+
+	got := 0
+	for i := 0; i < 2 * BUFFER; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("s%d", i)), nil); err != nil {
+			return err
+		}
+		changes, open := drain(busy)
+		if !open {
+			return fmt.Errorf("a receiver that keeps up lost its channel")
+		}
+		got += len(changes)
+	}
+	if got != 2 * BUFFER {
+		return fmt.Errorf("the receiver that keeps up got %d changes", got)
+	}
+	changes, open := drain(lazy)
+	if open || len(changes) != BUFFER {
+		return fmt.Errorf("the slow receiver got %d changes, open %v", len(changes), open)
+	}
+	return nil
+}
+
+// a done context closes the channel
+func cancelled(db *pandora_db.KV) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := db.Watch(ctx, nil)
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			return fmt.Errorf("a change after the context was done")
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("the channel is open after the context was done")
+	}
+	return nil
+}
+
+// wait for the goroutines of the closed channels to exit
+func settle(base int) int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > base; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	return n
+}
+
+func run() error {
+	base := runtime.NumGoroutine()
+	db, err := pandora_db.Open(path, &pandora_db.OpenOptions{
+		CreateIfMissing: true, WatchBuffer: BUFFER,
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.CreateBucket("b"); err != nil {
+		return err
+	}
+	opened := runtime.NumGoroutine()
+
+	for _, test := range []struct {
+		name string
+		fn func(*pandora_db.KV) error
+	}{{"order", order}, {"slow", slow}, {"cancelled", cancelled}} {
+		if err := test.fn(db); err != nil {
+			return fmt.Errorf("%s: %w", test.name, err)
+		}
+		if n := settle(opened); n > opened {
+			return fmt.Errorf("%s: %d goroutines left", test.name, n - opened)
+		}
+		fmt.Println(test.name, "ok")
+	}
+
+	// the receivers that stay open while the database closes
+	ch := db.Watch(context.Background(), nil)
+	db.Close()
+	if _, ok := <-ch; ok {
+		return fmt.Errorf("a change after the database closed")
+	}
+	if n := settle(base); n > base {
+		return fmt.Errorf("%d goroutines left after closing", n - base)
+	}
+	fmt.Println("close ok")
+	return nil
+}
+
+func main() {
+	os.Remove(path)
+	err := run()
+	os.Remove(path)
+	if err != nil {
+		fmt.Println("failed: ", err)
+		os.Exit(1)
+	}
+}
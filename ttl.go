@@ -0,0 +1,228 @@
+package pandora_db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// keys with a TTL leave room for the prefix and expiry in the index
+const TTL_MAX_KEY_SIZE = BTREE_MAX_KEY_SIZE - 1 - 8
+// expired keys deleted by one commit of the sweeper
+const TTL_SWEEP_BATCH = 256
+
+// SetWithTTL sets a value that expires after `ttl`. An expired key is
+// invisible right away and deleted by a background sweeper later.
+func (db *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	if len(key) > TTL_MAX_KEY_SIZE {
+		return fmt.Errorf(
+			"KV.SetWithTTL: key has %d bytes, more than TTL_MAX_KEY_SIZE %d",
+			len(key), TTL_MAX_KEY_SIZE,
+		)
+	}
+	assert(len(key) != 0)
+	assert(len(val) <= BTREE_MAX_VAL_SIZE)
+	assert(ttl > 0)
+
+	stored, vflags, err := valueEncode(db.codec, val)
+	if err != nil {
+		return err
+	}
+	expire := time.Now().Add(ttl).UnixNano()
+	stored, vflags = valueExpire(stored, vflags, expire)
+	req := commitReq{key: key, val: stored, vflags: vflags}
+	groupCommit(db, &req)
+	return req.err
+}
+
+// expiring value structure, flagged with BNODE_VAL_TTL in vlen
+// | expire | value, compressed or not |
+// |   8B   |           ...            |
+// `expire` is in unix nanoseconds.
+func valueExpire(stored []byte, vflags uint16, expire int64) ([]byte, uint16) {
+	data := make([]byte, VALUE_TTL_SIZE, VALUE_TTL_SIZE + len(stored))
+	binary.LittleEndian.PutUint64(data, uint64(expire))
+	return append(data, stored...), vflags | BNODE_VAL_TTL
+}
+
+// the expiry of a stored value, 0 if it has none
+func valueExpiry(stored []byte, vflags uint16) int64 {
+	if vflags & BNODE_VAL_TTL == 0 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(stored))
+}
+
+func valueExpired(stored []byte, vflags uint16, now int64) bool {
+	expire := valueExpiry(stored, vflags)
+	return expire != 0 && expire <= now
+}
+
+// the stored value without its expiry
+func valueUnexpire(stored []byte, vflags uint16) ([]byte, uint16) {
+	if vflags & BNODE_VAL_TTL == 0 {
+		return stored, vflags
+	}
+	return stored[VALUE_TTL_SIZE:], vflags &^ BNODE_VAL_TTL
+}
+
+// expiry index entry, ordered by time
+// | 't' | expire | key |
+// |  1B |   8B   | ... |
+func ttlKey(expire int64, key []byte) []byte {
+	var be [8]byte
+	binary.BigEndian.PutUint64(be[:], uint64(expire))
+	return metaKey(META_TTL, be[:], key)
+}
+
+// drop `key` from the expiry index, returns false if it was not set
+// or had expired
+func ttlUnindex(db *KV, key []byte) bool {
+	stored, vflags, ok := db.tree.getStored(key)
+	if !ok {
+		return false
+	}
+	expire := valueExpiry(stored, vflags)
+	if expire == 0 {
+		return true
+	}
+	db.meta.Delete(ttlKey(expire, key))
+	return expire > time.Now().UnixNano()
+}
+
+// true if the expiry index has an entry
+func ttlAny(db *KV) bool {
+	found := false
+	db.meta.Scan(ttlKey(0, nil), func(ikey []byte, _ []byte) bool {
+		found = ikey[0] == META_TTL
+		return false
+	})
+	return found
+}
+
+// set a key and keep the expiry index in step, for commits and the WAL.
+// Without a key that expires there is no index to look up.
+func applySet(db *KV, key []byte, val []byte, vflags uint16) {
+	old, oflags := watchOld(db, &db.tree, key)
+	if db.ttlIndexed {
+		ttlUnindex(db, key)
+	}
+	db.tree.insert(key, val, vflags)
+	if expire := valueExpiry(val, vflags); expire != 0 {
+		db.meta.Insert(ttlKey(expire, key), nil)
+		db.ttlIndexed = true
+	}
+	recordChange(db, "", key, old, oflags, val, vflags, ChangeSet)
+}
+
+// delete a key, returns false if there was none or it had expired
+func applyDel(db *KV, key []byte) bool {
+	old, oflags := watchOld(db, &db.tree, key)
+	visible := true
+	if db.ttlIndexed {
+		visible = ttlUnindex(db, key)
+	}
+	if !db.tree.Delete(key) {
+		changeSkip(db)
+		return false
+	}
+	recordChange(db, "", key, old, oflags, nil, 0, ChangeDel)
+	return visible
+}
+
+// delete up to TTL_SWEEP_BATCH expired keys, oldest first, and return
+// them for the WAL
+func ttlSweep(db *KV) [][]byte {
+	now := time.Now().UnixNano()
+	start := ttlKey(0, nil)
+	index := [][]byte{}
+	db.meta.Scan(start, func(ikey []byte, _ []byte) bool {
+		if ikey[0] != META_TTL || len(index) == TTL_SWEEP_BATCH {
+			return false
+		}
+		if int64(binary.BigEndian.Uint64(ikey[1:])) > now {
+			return false
+		}
+		index = append(index, append([]byte{}, ikey...))
+		return true
+	})
+
+	swept := [][]byte{}
+	for _, ikey := range index {
+		key := ikey[1 + 8:]
+		stored, vflags, ok := db.tree.getStored(key)
+		if ok && bytes.Equal(ikey, ttlKey(valueExpiry(stored, vflags), key)) {
+			applyDel(db, key)
+			swept = append(swept, key)
+		} else {
+			db.meta.Delete(ikey) // the key was overwritten
+		}
+	}
+	return swept
+}
+
+// true if some key expired and is not swept yet
+func ttlDue(db *KV) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	due := false
+	db.meta.Scan(ttlKey(0, nil), func(ikey []byte, _ []byte) bool {
+		due = ikey[0] == META_TTL &&
+			int64(binary.BigEndian.Uint64(ikey[1:])) <= time.Now().UnixNano()
+		return false
+	})
+	return due
+}
+
+// background deletion of expired keys every `TTLSweepInterval`, each
+// batch is an ordinary commit
+func sweepLoop(db *KV, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(db.opts.TTLSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for ttlDue(db) {
+			req := commitReq{sweep: true}
+			groupCommit(db, &req)
+			if req.err != nil || len(req.swept) < TTL_SWEEP_BATCH {
+				break
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// start the sweeper once a key expires, with the lock held
+func ttlStart(db *KV) {
+	if db.ttlIndexed && db.sweepStop == nil && !readOnly(db) {
+		startSweepLoop(db)
+	}
+}
+
+func startSweepLoop(db *KV) {
+	db.sweepStop = make(chan struct{})
+	db.sweepDone = make(chan struct{})
+	go sweepLoop(db, db.sweepStop, db.sweepDone)
+}
+
+func stopSweepLoop(db *KV) {
+	close(db.sweepStop)
+	<-db.sweepDone
+	db.sweepStop = nil
+	db.sweepDone = nil
+}
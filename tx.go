@@ -0,0 +1,326 @@
+package pandora_db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrTxReadOnly = errors.New("transaction is read-only")
+var ErrTxDone = errors.New("transaction is over")
+
+// a change made by a transaction, see `applyOp`
+type txOp struct {
+	code byte // WAL_OP_SET, WAL_OP_DEL, WAL_OP_CREATE_BUCKET or WAL_OP_DROP_BUCKET
+	bucket string // "" for the keys outside buckets
+	key []byte
+	val []byte // as stored, see `valueEncode`
+	vflags uint16
+}
+
+// the changes of a transaction to one bucket, for its own reads
+type txBucket struct {
+	fresh bool // created by the transaction, nothing of it is committed
+	dropped bool
+	keys map[string][]byte // the values set, nil for deleted keys
+}
+
+// Tx is a transaction of `KV.Update` or `KV.View`. It sees the latest
+// commit and its own changes, which are committed all together or not
+// at all.
+type Tx struct {
+	db *KV
+	writable bool
+	done bool
+	ops []txOp
+	buckets map[string]*txBucket // "" is for the keys outside buckets
+}
+
+// Update runs `fn` in a transaction that commits when it returns nil,
+// along with the concurrent writes. `fn` runs with the database locked,
+// it must only use `tx` and should be quick. A panic in `fn` is
+// returned as an error and changes nothing.
+func (db *KV) Update(fn func(tx *Tx) error) error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	req := commitReq{update: fn}
+	groupCommit(db, &req)
+	return req.err
+}
+
+// View runs `fn` in a read-only transaction, writers wait until it
+// returns.
+func (db *KV) View(fn func(tx *Tx) error) error {
+	if db.readers != nil && db.opts.ReadOnly {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if !readerPin(db) {
+			return ErrNothingCommitted
+		}
+		defer readerUnpin(db)
+	} else {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+	}
+	tx := &Tx{db: db, buckets: map[string]*txBucket{}}
+	defer func() { tx.done = true }()
+	return fn(tx)
+}
+
+// run the function of an update in the leader of a batch, its changes
+// are applied only if it succeeds
+func txRun(db *KV, fn func(*Tx) error) ([]txOp, error) {
+	tx := &Tx{db: db, writable: true, buckets: map[string]*txBucket{}}
+	err := txCall(tx, fn)
+	tx.done = true
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range tx.ops {
+		applyOp(db, op)
+	}
+	return tx.ops, nil
+}
+
+// `fn` runs on the goroutine of the leader, which holds the lock for
+// the whole batch. A panic in it fails its own update instead of the
+// leader.
+func txCall(tx *Tx, fn func(*Tx) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("KV.Update: panic: %v", r)
+		}
+	}()
+	return fn(tx)
+}
+
+func (tx *Tx) Get(key []byte) ([]byte, bool) {
+	val, ok, _ := tx.get("", key)
+	return val, ok
+}
+
+func (tx *Tx) Set(key []byte, val []byte) error {
+	return tx.set("", key, val, 0)
+}
+
+func (tx *Tx) Del(key []byte) (bool, error) {
+	return tx.del("", key)
+}
+
+// Scan is like `KV.Scan` with the changes of the transaction.
+func (tx *Tx) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	_ = tx.scan("", start, fn)
+}
+
+func (tx *Tx) CreateBucket(name string) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	if err := bucketCheckName(name); err != nil {
+		return err
+	}
+	if tx.exists(name) {
+		return ErrBucketExists
+	}
+	tx.ops = append(tx.ops, txOp{code: WAL_OP_CREATE_BUCKET, bucket: name})
+	tb := tx.track(name)
+	tb.fresh, tb.dropped = true, false
+	tb.keys = map[string][]byte{}
+	return nil
+}
+
+// Bucket returns the bucket `name` for use in the transaction.
+func (tx *Tx) Bucket(name string) (*Bucket, error) {
+	if name == "" || !tx.exists(name) {
+		return nil, ErrBucketNotFound
+	}
+	return &Bucket{db: tx.db, tx: tx, name: name}, nil
+}
+
+// DropBucket deletes a bucket and its keys, the pages of its tree go
+// to the free list.
+func (tx *Tx) DropBucket(name string) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	if name == "" || !tx.exists(name) {
+		return ErrBucketNotFound
+	}
+	tx.ops = append(tx.ops, txOp{code: WAL_OP_DROP_BUCKET, bucket: name})
+	tb := tx.track(name)
+	tb.fresh, tb.dropped = false, true
+	tb.keys = map[string][]byte{}
+	return nil
+}
+
+// ListBuckets returns the names of the buckets in order.
+func (tx *Tx) ListBuckets() []string {
+	names := []string{}
+	committed := map[string]bool{}
+	for _, name := range bucketNames(tx.db) {
+		committed[name] = true
+		if tb := tx.buckets[name]; tb == nil || !tb.dropped {
+			names = append(names, name)
+		}
+	}
+	// a committed bucket dropped and created again is listed already
+	for name, tb := range tx.buckets {
+		if tb.fresh && !committed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (tx *Tx) writeCheck() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	return nil
+}
+
+func (tx *Tx) track(name string) *txBucket {
+	tb := tx.buckets[name]
+	if tb == nil {
+		tb = &txBucket{keys: map[string][]byte{}}
+		tx.buckets[name] = tb
+	}
+	return tb
+}
+
+func (tx *Tx) exists(name string) bool {
+	if name == "" {
+		return true
+	}
+	if tb := tx.buckets[name]; tb != nil && (tb.fresh || tb.dropped) {
+		return tb.fresh
+	}
+	_, ok := bucketRoot(tx.db, name)
+	return ok
+}
+
+// the committed tree of a bucket, empty for one created by the transaction
+func (tx *Tx) tree(name string) BTree {
+	if name == "" {
+		return tx.db.tree
+	}
+	if tb := tx.buckets[name]; tb != nil && tb.fresh {
+		return bucketTree(tx.db, 0)
+	}
+	root, _ := bucketRoot(tx.db, name)
+	return bucketTree(tx.db, root)
+}
+
+func (tx *Tx) get(name string, key []byte) ([]byte, bool, error) {
+	if !tx.exists(name) {
+		return nil, false, ErrBucketNotFound
+	}
+	if tb := tx.buckets[name]; tb != nil {
+		if val, ok := tb.keys[string(key)]; ok {
+			return val, val != nil, nil
+		}
+	}
+	tree := tx.tree(name)
+	val, ok := tree.Get(key)
+	return val, ok, nil
+}
+
+// set a key, which expires at `expire` unless it is 0
+func (tx *Tx) set(name string, key []byte, val []byte, expire int64) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	assert(len(key) != 0)
+	assert(len(key) <= BTREE_MAX_KEY_SIZE)
+	assert(len(val) <= BTREE_MAX_VAL_SIZE)
+	if !tx.exists(name) {
+		return ErrBucketNotFound
+	}
+
+	stored, vflags, err := valueEncode(tx.db.codec, val)
+	if err != nil {
+		return err
+	}
+	// the caller may reuse its slices
+	key = append([]byte{}, key...)
+	if expire != 0 {
+		stored, vflags = valueExpire(stored, vflags, expire)
+	} else if vflags == 0 {
+		stored = append([]byte{}, stored...)
+	}
+	tx.ops = append(tx.ops, txOp{code: WAL_OP_SET, bucket: name, key: key, val: stored, vflags: vflags})
+	tx.track(name).keys[string(key)] = append([]byte{}, val...)
+	return nil
+}
+
+func (tx *Tx) del(name string, key []byte) (bool, error) {
+	if err := tx.writeCheck(); err != nil {
+		return false, err
+	}
+	assert(len(key) != 0)
+	assert(len(key) <= BTREE_MAX_KEY_SIZE)
+	_, found, err := tx.get(name, key)
+	if err != nil {
+		return false, err
+	}
+
+	key = append([]byte{}, key...)
+	tx.ops = append(tx.ops, txOp{code: WAL_OP_DEL, bucket: name, key: key})
+	tx.track(name).keys[string(key)] = nil
+	return found, nil
+}
+
+// the committed keys merged with the ones changed by the transaction
+func (tx *Tx) scan(name string, start []byte, fn func(key []byte, val []byte) bool) error {
+	if !tx.exists(name) {
+		return ErrBucketNotFound
+	}
+	changed := []string{}
+	tb := tx.buckets[name]
+	if tb != nil {
+		for key := range tb.keys {
+			if key >= string(start) {
+				changed = append(changed, key)
+			}
+		}
+		sort.Strings(changed)
+	}
+	// the changed keys before `key`, false if `fn` stopped
+	flush := func(key []byte) bool {
+		for len(changed) > 0 && (key == nil || changed[0] < string(key)) {
+			val := tb.keys[changed[0]]
+			if val != nil && !fn([]byte(changed[0]), val) {
+				return false
+			}
+			changed = changed[1:]
+		}
+		return true
+	}
+
+	stopped := false
+	tree := tx.tree(name)
+	tree.Scan(start, func(key []byte, val []byte) bool {
+		if !flush(key) {
+			stopped = true
+			return false
+		}
+		if len(changed) > 0 && bytes.Equal([]byte(changed[0]), key) {
+			return true // flushed with the next key
+		}
+		if !fn(key, val) {
+			stopped = true
+			return false
+		}
+		return true
+	})
+	if !stopped {
+		flush(nil)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package pandora_db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const WAL_OP_SET = 1
+const WAL_OP_DEL = 2
+const WAL_OP_SET_COMPRESSED = 3 // written before vlen had the value flags
+const WAL_OP_BUCKET = 4 // the bucket of the next ops, the key is its name
+const WAL_OP_CREATE_BUCKET = 5
+const WAL_OP_DROP_BUCKET = 6
+const WAL_OP_COMMIT = 7 // the version of the commit, the key is 8B
+// the value of WAL_OP_COMMIT has flags, this one when it logs its changes
+const WAL_COMMIT_CHANGELOG = 1
+const WAL_OP_TRIM_CHANGES = 8 // the key is the last sequence number trimmed
+const WAL_RECORD_HEADER = 4 + 4
+
+// WAL record, one per commit, the ops are replayed in order
+// | size | crc32 | ops: | op | klen | vlen | key | val | |
+// |  4B  |  4B   |      | 1B |  2B  |  2B  | ... | ... | |
+// The top bits of vlen are the flags of the stored value, like in a
+// node. The ops of a record are outside buckets until WAL_OP_BUCKET,
+// which has the bucket name for a key, "" for none. Every commit in the
+// log has a version of its own, like a commit to the main file, which
+// comes first in its record. Replaying the log twice gives the same result, so a crash
+// between a checkpoint and the truncation of the log is harmless. In
+// an encrypted database the ops are sealed like a page, with the nonce
+// at the end.
+func walRecord(pc *pageCipher, batch []*commitReq, version uint64, changelog bool) ([]byte, error) {
+	data := make([]byte, WAL_RECORD_HEADER)
+	put := func(code byte, key []byte, val []byte, vflags uint16) {
+		var op [5]byte
+		op[0] = code
+		binary.LittleEndian.PutUint16(op[1:], uint16(len(key)))
+		binary.LittleEndian.PutUint16(op[3:], uint16(len(val)) | vflags)
+		data = append(data, op[:]...)
+		data = append(data, key...)
+		data = append(data, val...)
+	}
+	var commit [8]byte
+	binary.LittleEndian.PutUint64(commit[:], version)
+	flags := []byte{0}
+	if changelog {
+		flags[0] |= WAL_COMMIT_CHANGELOG
+	}
+	put(WAL_OP_COMMIT, commit[:], flags, 0)
+	bucket := ""
+	use := func(name string) {
+		if name != bucket {
+			put(WAL_OP_BUCKET, []byte(name), nil, 0)
+			bucket = name
+		}
+	}
+	for _, req := range batch {
+		if req.update == nil {
+			use("")
+		}
+		switch {
+		case req.update != nil:
+			for _, op := range req.ops {
+				switch op.code {
+				case WAL_OP_CREATE_BUCKET, WAL_OP_DROP_BUCKET:
+					put(op.code, []byte(op.bucket), nil, 0)
+				default:
+					use(op.bucket)
+					put(op.code, op.key, op.val, op.vflags)
+				}
+			}
+		case req.trim:
+			if req.trimmed > 0 {
+				var seq [8]byte
+				binary.LittleEndian.PutUint64(seq[:], req.trimSeq)
+				put(WAL_OP_TRIM_CHANGES, seq[:], nil, 0)
+			}
+		case req.sweep:
+			for _, key := range req.swept {
+				put(WAL_OP_DEL, key, nil, 0)
+			}
+		case req.del:
+			put(WAL_OP_DEL, req.key, nil, 0)
+		default:
+			put(WAL_OP_SET, req.key, req.val, req.vflags)
+		}
+	}
+	if pc != nil {
+		var err error
+		sealed := make([]byte, WAL_RECORD_HEADER)
+		sealed, err = cryptSeal(pc, sealed, data[WAL_RECORD_HEADER:], nil)
+		if err != nil {
+			return nil, err
+		}
+		data = sealed
+	}
+	payload := data[WAL_RECORD_HEADER:]
+	binary.LittleEndian.PutUint32(data[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+	return data, nil
+}
+
+// apply the ops of one record to the trees
+func walApply(db *KV, payload []byte) error {
+	bucket := ""
+	for len(payload) > 0 {
+		if len(payload) < 5 {
+			return errors.New("truncated WAL op")
+		}
+		op := payload[0]
+		klen := int(binary.LittleEndian.Uint16(payload[1:]))
+		vlen := int(binary.LittleEndian.Uint16(payload[3:]))
+		vflags := uint16(vlen) & BNODE_VAL_FLAGS
+		vlen &^= BNODE_VAL_FLAGS
+		payload = payload[5:]
+		if len(payload) < klen + vlen {
+			return errors.New("truncated WAL op")
+		}
+		if (klen == 0 && op != WAL_OP_BUCKET) || klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_VAL_SIZE + VALUE_TTL_SIZE {
+			return errors.New("bad WAL op")
+		}
+		key, val := payload[:klen], payload[klen : klen + vlen]
+		payload = payload[klen + vlen:]
+
+		switch op {
+		case WAL_OP_SET:
+			applyOp(db, txOp{code: op, bucket: bucket, key: key, val: val, vflags: vflags})
+		case WAL_OP_SET_COMPRESSED:
+			applyOp(db, txOp{code: WAL_OP_SET, key: key, val: val, vflags: BNODE_VAL_COMPRESSED})
+		case WAL_OP_DEL:
+			applyOp(db, txOp{code: op, bucket: bucket, key: key})
+		case WAL_OP_BUCKET:
+			bucket = string(key)
+		case WAL_OP_CREATE_BUCKET, WAL_OP_DROP_BUCKET:
+			applyOp(db, txOp{code: op, bucket: string(key)})
+		case WAL_OP_COMMIT:
+			if klen != 8 {
+				return errors.New("bad WAL op")
+			}
+			version := binary.LittleEndian.Uint64(key)
+			on := len(val) > 0 && val[0] & WAL_COMMIT_CHANGELOG != 0
+			changesBegin(db, version, on)
+			// a checkpoint may have moved the version past the log
+			if version > db.version {
+				db.version = version
+			}
+		case WAL_OP_TRIM_CHANGES:
+			if klen != 8 {
+				return errors.New("bad WAL op")
+			}
+			changesTrim(db, binary.LittleEndian.Uint64(key), 0)
+		default:
+			return fmt.Errorf("bad WAL op %d", op)
+		}
+	}
+	return nil
+}
+
+// replay the "-wal" file left by the last process and keep it open in
+// WAL mode, the replayed commits are checkpointed by a writer
+func openWAL(db *KV) error {
+	flags := os.O_RDWR
+	if db.opts.ReadOnly {
+		flags = os.O_RDONLY
+	} else if db.opts.WAL {
+		flags |= os.O_CREATE
+	}
+	fp, err := db.opts.OpenFile(db.Path + "-wal", flags, db.opts.FileMode)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+	db.wal.fp = fp
+	if err := walReplay(db); err != nil {
+		return fmt.Errorf("replay WAL: %w", err)
+	}
+
+	if db.opts.ReadOnly {
+		// the replayed pages stay in memory
+		_ = fp.Close()
+		db.wal.fp = nil
+		return nil
+	}
+	if err := checkpoint(db); err != nil {
+		return err
+	}
+	if !db.opts.WAL {
+		_ = fp.Close()
+		db.wal.fp = nil
+		return os.Remove(db.Path + "-wal")
+	}
+	return nil
+}
+
+// apply the records in the WAL to the tree, up to the first one that
+// is torn, which is a commit that never returned
+func walReplay(db *KV) error {
+	size, err := db.wal.fp.Size()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	if _, err := db.wal.fp.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	db.wal.size = 0
+	for len(data) >= WAL_RECORD_HEADER {
+		size := int(binary.LittleEndian.Uint32(data[0:]))
+		sum := binary.LittleEndian.Uint32(data[4:])
+		if len(data) - WAL_RECORD_HEADER < size {
+			break
+		}
+		payload := data[WAL_RECORD_HEADER : WAL_RECORD_HEADER + size]
+		if crc32.ChecksumIEEE(payload) != sum {
+			break
+		}
+		if db.crypt != nil {
+			payload, err = cryptOpen(db.crypt, payload, nil)
+			if err != nil {
+				return fmt.Errorf("decrypt WAL: %w", err)
+			}
+		}
+		// records written before WAL_OP_COMMIT
+		changesBegin(db, db.version + 1, db.opts.ChangeLog)
+		if err := walApply(db, payload); err != nil {
+			return err
+		}
+		data = data[WAL_RECORD_HEADER + size:]
+		db.wal.size += int64(WAL_RECORD_HEADER + size)
+	}
+	return nil
+}
+
+func closeWAL(db *KV) {
+	if !db.opts.ReadOnly {
+		_ = checkpoint(db)
+	}
+	_ = db.wal.fp.Close()
+	db.wal.fp = nil
+}
+
+// log a batch of changes already applied to the tree, their pages stay
+// in `page.updates` until the next checkpoint
+func walCommit(db *KV, batch []*commitReq) error {
+	if err := fatalCheck(db); err != nil {
+		rollback(db)
+		return err
+	}
+	db.version++
+	record, err := walRecord(db.crypt, batch, db.version, db.opts.ChangeLog)
+	if err != nil {
+		rollback(db)
+		return err
+	}
+	if _, err := db.wal.fp.WriteAt(record, db.wal.size); err != nil {
+		rollback(db)
+		return fmt.Errorf("write WAL: %w", err)
+	}
+
+	switch db.opts.SyncMode {
+	case SyncFull:
+		err = db.wal.fp.Sync()
+	case SyncData:
+		err = db.wal.fp.Datasync()
+	}
+	if err != nil {
+		// the record may or may not be on disk, it is cut off and the
+		// next one takes its place
+		if err := db.wal.fp.Truncate(db.wal.size); err != nil {
+			db.fatal = fmt.Errorf("truncate WAL: %w", err)
+		}
+		rollback(db)
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	db.wal.size += int64(len(record))
+	// the master page waits for the checkpoint
+	db.synced = db.version
+
+	if db.wal.size >= int64(db.opts.WALCheckpointSize) {
+		return checkpoint(db)
+	}
+	return nil
+}
+
+// write the pages changed since the last checkpoint to the main file
+// and empty the log
+func checkpoint(db *KV) error {
+	// the version goes to the master page even if nothing changed
+	if len(db.page.updates) > 0 || db.version != db.last.version {
+		if err := flushPages(db); err != nil {
+			return fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+	if db.wal.size == 0 {
+		return nil
+	}
+	if err := db.wal.fp.Truncate(0); err != nil {
+		return fmt.Errorf("checkpoint: truncate WAL: %w", err)
+	}
+	db.wal.size = 0
+	return nil
+}
+
+// Checkpoint copies the commits in the WAL to the main file.
+func (db *KV) Checkpoint() error {
+	if readOnly(db) {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.wal.fp == nil {
+		return nil
+	}
+	if err := checkpoint(db); err != nil {
+		return fmt.Errorf("KV.Checkpoint: %w", err)
+	}
+	return nil
+}
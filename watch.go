@@ -0,0 +1,184 @@
+package pandora_db
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+type ChangeOp int
+
+const (
+	ChangeSet ChangeOp = iota + 1
+	ChangeDel
+)
+
+// Change is a committed Set or Del seen by `KV.Watch` or logged for
+// `KV.Changes`.
+type Change struct {
+	Seq uint64 // in the changelog, 0 for `KV.Watch`
+	Bucket string // "" for the keys outside buckets
+	Key []byte
+	Old []byte // nil if the key was not set
+	New []byte // nil for ChangeDel
+	Op ChangeOp
+	Commit uint64 // the version of the commit that made the change
+}
+
+type watcher struct {
+	bucket string
+	prefix []byte
+	ch chan Change
+	done chan struct{} // closed with `ch`, ends the wait for `ctx`
+	closed bool
+}
+
+// Watch sends the changes to keys outside buckets that start with
+// `prefix` once their commit is written, in commit order. Up to
+// `OpenOptions.WatchBuffer` changes wait for the receiver, a receiver
+// that falls further behind loses its channel: it is closed, as it is
+// when `ctx` is done or the database is closed. A commit never waits
+// for a receiver. Expired keys show up as deleted once swept, dropped
+// buckets have no changes. Every receiver gets changes of its own.
+func (db *KV) Watch(ctx context.Context, prefix []byte) <-chan Change {
+	return watch(db, ctx, "", prefix)
+}
+
+// Watch is like `KV.Watch` for the keys of the bucket.
+func (b *Bucket) Watch(ctx context.Context, prefix []byte) <-chan Change {
+	return watch(b.db, ctx, b.name, prefix)
+}
+
+func watch(db *KV, ctx context.Context, bucket string, prefix []byte) <-chan Change {
+	w := &watcher{
+		bucket: bucket,
+		prefix: append([]byte{}, prefix...),
+		ch: make(chan Change, db.opts.WatchBuffer),
+		done: make(chan struct{}),
+	}
+	db.watch.mu.Lock()
+	db.watch.list = append(db.watch.list, w)
+	db.watch.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+			return
+		}
+		db.watch.mu.Lock()
+		watchClose(db, w)
+		db.watch.mu.Unlock()
+	}()
+	return w.ch
+}
+
+// with `watch.mu` held
+func watchClose(db *KV, w *watcher) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.ch)
+	close(w.done)
+	for i, other := range db.watch.list {
+		if other == w {
+			db.watch.list = append(db.watch.list[:i], db.watch.list[i + 1:]...)
+			break
+		}
+	}
+}
+
+func watchCloseAll(db *KV) {
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for len(db.watch.list) > 0 {
+		watchClose(db, db.watch.list[0])
+	}
+}
+
+// start collecting the changes of a batch, if anyone is watching
+func watchBegin(db *KV) {
+	db.watch.mu.Lock()
+	db.watch.on = len(db.watch.list) > 0
+	db.watch.mu.Unlock()
+	db.watch.changes = nil
+}
+
+// the value of `key` before a change, if anyone is watching
+func watchOld(db *KV, tree *BTree, key []byte) ([]byte, uint16) {
+	if !db.watch.on {
+		return nil, 0
+	}
+	stored, vflags, ok := tree.getStored(key)
+	if !ok || valueExpired(stored, vflags, time.Now().UnixNano()) {
+		return nil, 0
+	}
+	return stored, vflags
+}
+
+// a change applied to a tree, `old` and `new` are as stored
+func recordChange(db *KV, bucket string, key []byte, old []byte, oflags uint16, new []byte, nflags uint16, op ChangeOp) {
+	if db.changes.on {
+		changeLog(db, bucket, key, new, nflags, op)
+	}
+	if !db.watch.on {
+		return
+	}
+	change := Change{Bucket: bucket, Key: append([]byte{}, key...), Op: op, Commit: db.changes.version}
+	if old != nil {
+		val, err := valueLogical(old, oflags)
+		if err != nil {
+			db.valueCorrupt(err)
+		}
+		change.Old = append([]byte{}, val...)
+	}
+	if new != nil {
+		val, err := valueLogical(new, nflags)
+		if err != nil {
+			db.valueCorrupt(err)
+		}
+		change.New = append([]byte{}, val...)
+	}
+	db.watch.changes = append(db.watch.changes, change)
+}
+
+// a copy that keeps nil apart from empty
+func changeValueCopy(val []byte) []byte {
+	if val == nil {
+		return nil
+	}
+	return append([]byte{}, val...)
+}
+
+// send the changes of a batch once it is committed
+func watchEnd(db *KV, err error) {
+	changes := db.watch.changes
+	db.watch.changes = nil
+	if !db.watch.on || err != nil {
+		return
+	}
+	db.watch.on = false
+
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for _, w := range append([]*watcher{}, db.watch.list...) {
+		for _, change := range changes {
+			if change.Bucket != w.bucket || !bytes.HasPrefix(change.Key, w.prefix) {
+				continue
+			}
+			// the slices are not shared between receivers
+			change.Key = append([]byte{}, change.Key...)
+			change.Old = changeValueCopy(change.Old)
+			change.New = changeValueCopy(change.New)
+			select {
+			case w.ch <- change:
+			default:
+				watchClose(db, w) // too slow
+			}
+			if w.closed {
+				break
+			}
+		}
+	}
+}